@@ -0,0 +1,97 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// reservedAppAttributes are the attributes of the Omaha app element set by
+// Unattended
+var reservedAppAttributes = map[string]bool{
+	"appid":   true,
+	"status":  true,
+	"version": true,
+	"track":   true,
+	"bootid":  true,
+}
+
+// AppAttributes provides custom attributes sent with the applications in the
+// requests to the server, for example the hardware model or a site ID, to
+// allow the server to select the right manifest
+type AppAttributes interface {
+	// Attributes returns the attributes of the application by name
+	Attributes(appID string) map[string]string
+}
+
+// StaticAppAttributes are the same attributes for all applications
+type StaticAppAttributes map[string]string
+
+// Attributes returns the static attributes
+func (attributes StaticAppAttributes) Attributes(appID string) map[string]string {
+	return attributes
+}
+
+// appAttributes returns the custom attributes of the application, sorted by
+// name. Attributes set by Unattended can't be replaced and attributes with
+// names that are not valid XML names are skipped
+func (updater *Unattended) appAttributes(appID string) []xml.Attr {
+	if updater.target.AppAttributes == nil {
+		return nil
+	}
+	var attributes []xml.Attr
+	for name, value := range updater.target.AppAttributes.Attributes(appID) {
+		if reservedAppAttributes[name] {
+			updater.log.WithField(
+				"attribute", name,
+			).Warning("Skipping reserved app attribute")
+			continue
+		}
+		if isXMLName(name) == false {
+			updater.log.WithField(
+				"attribute", name,
+			).Warning("Skipping app attribute with an invalid name")
+			continue
+		}
+		attributes = append(attributes, xml.Attr{
+			Name:  xml.Name{Local: name},
+			Value: value,
+		})
+	}
+	sort.Slice(attributes, func(i, j int) bool {
+		return attributes[i].Name.Local < attributes[j].Name.Local
+	})
+	return attributes
+}
+
+// isXMLName returns true if the name is a valid XML attribute name without a
+// namespace prefix. Names starting with 'xml' are reserved
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		if unicode.IsLetter(r) || r == '_' {
+			continue
+		}
+		if i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"testing"
+)
+
+func TestAppAttributesSkipsInvalidNames(t *testing.T) {
+	updater := newTestUpdater(t, Target{
+		AppAttributes: StaticAppAttributes{
+			"model":      "x1",
+			"site_id":    "7",
+			"hw.rev-2":   "b",
+			"appid":      "other",
+			"2fast":      "x",
+			"-model":     "x",
+			"has space":  "x",
+			"quote\"":    "x",
+			"ns:model":   "x",
+			"xmlns":      "x",
+			"XMLthing":   "x",
+			"":           "x",
+			"modèle":     "x1",
+			"model>evil": "x",
+		},
+	})
+
+	var names []string
+	for _, attribute := range updater.appAttributes("app") {
+		names = append(names, attribute.Name.Local)
+	}
+	expected := []string{"hw.rev-2", "model", "modèle", "site_id"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected attributes %v, got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected attributes %v, got %v", expected, names)
+		}
+	}
+}
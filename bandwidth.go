@@ -0,0 +1,185 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// rateLimitChunks is the number of reads a second of limited bandwidth is
+	// split into, keeping the rate smooth
+	rateLimitChunks = 10
+	// minRateLimitChunk is the smallest read of a rate limited download
+	minRateLimitChunk = 512
+)
+
+// ErrOutsideDownloadWindow is returned when a download is stopped because
+// the current time is outside of the target's download windows. The
+// partial download is resumed in the next window
+var ErrOutsideDownloadWindow = errors.New("Outside of the download windows")
+
+// TimeWindow is a daily window of local time. Windows ending before they
+// start span midnight, windows with equal start and end span the whole day
+type TimeWindow struct {
+	// Start is the time since midnight the window starts at
+	Start time.Duration
+	// End is the time since midnight the window ends at
+	End time.Duration
+}
+
+// ParseTimeWindow parses a window in the form '01:00-05:00'
+func ParseTimeWindow(window string) (TimeWindow, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return TimeWindow{}, fmt.Errorf("Invalid time window '%s'", window)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return TimeWindow{}, fmt.Errorf("Invalid time window '%s': %s", window, err)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil {
+		return TimeWindow{}, fmt.Errorf("Invalid time window '%s': %s", window, err)
+	}
+	return TimeWindow{
+		Start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+		End:   time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute,
+	}, nil
+}
+
+// Contains returns true if the time is inside the window
+func (window TimeWindow) Contains(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	timeOfDay := now.Sub(midnight)
+	if window.Start == window.End {
+		return true
+	}
+	if window.Start < window.End {
+		return timeOfDay >= window.Start && timeOfDay < window.End
+	}
+	return timeOfDay >= window.Start || timeOfDay < window.End
+}
+
+// BandwidthLimit caps the rate of package downloads
+type BandwidthLimit struct {
+	// Rate in bytes per second, 0 is unlimited
+	Rate int64
+	// Schedule overrides Rate during its windows. The first matching window
+	// applies
+	Schedule []BandwidthSchedule
+}
+
+// BandwidthSchedule is the download rate during a time window
+type BandwidthSchedule struct {
+	// Window the rate applies to
+	Window TimeWindow
+	// Rate in bytes per second, 0 is unlimited
+	Rate int64
+}
+
+// rate returns the rate in bytes per second at the given time, 0 is
+// unlimited
+func (limit BandwidthLimit) rate(now time.Time) int64 {
+	for _, schedule := range limit.Schedule {
+		if schedule.Window.Contains(now) {
+			return schedule.Rate
+		}
+	}
+	return limit.Rate
+}
+
+// inDownloadWindow returns true if downloads are allowed at the given time
+func (updater *Unattended) inDownloadWindow(now time.Time) bool {
+	if len(updater.target.DownloadWindows) == 0 {
+		return true
+	}
+	for _, window := range updater.target.DownloadWindows {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedReader reads a download within the bandwidth limit and download
+// windows of the target
+type limitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	updater *Unattended
+	// rate, started and read track the current rate since it last changed
+	rate    int64
+	started time.Time
+	read    int64
+}
+
+// limitDownload returns a reader of the download that applies the bandwidth
+// limit and download windows of the target
+func (updater *Unattended) limitDownload(ctx context.Context, reader io.Reader) io.Reader {
+	return &limitedReader{
+		ctx:     ctx,
+		reader:  reader,
+		updater: updater,
+	}
+}
+
+// Read reads from the download, waiting as long as needed to stay within
+// the rate
+func (limited *limitedReader) Read(content []byte) (int, error) {
+	now := time.Now()
+	if limited.updater.inDownloadWindow(now) == false {
+		return 0, ErrOutsideDownloadWindow
+	}
+
+	rate := limited.updater.target.BandwidthLimit.rate(now)
+	if rate != limited.rate {
+		limited.rate = rate
+		limited.started = now
+		limited.read = 0
+	}
+	if rate <= 0 {
+		return limited.reader.Read(content)
+	}
+
+	chunk := rate / rateLimitChunks
+	if chunk < minRateLimitChunk {
+		chunk = minRateLimitChunk
+	}
+	if int64(len(content)) > chunk {
+		content = content[:chunk]
+	}
+	read, err := limited.reader.Read(content)
+	limited.read += int64(read)
+
+	// Wait until the bytes read so far are within the rate
+	due := limited.started.Add(time.Duration(float64(limited.read) / float64(rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-limited.ctx.Done():
+			timer.Stop()
+			if err == nil {
+				err = limited.ctx.Err()
+			}
+		}
+	}
+	return read, err
+}
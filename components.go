@@ -0,0 +1,181 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+	"github.com/sirupsen/logrus"
+)
+
+// Component is a companion of the target, such as a plugin, data bundle or
+// model. Components are updated with the target, each version is installed
+// into its own directory in the component's VersionsPath
+type Component struct {
+	// AppID is the unique ID of the component to use in checking for
+	// updates
+	AppID string
+	// UpdateChannel of the component, defaults to the target's
+	// UpdateChannel
+	UpdateChannel string
+	// VersionsPath is the base path the versioned directories of the
+	// component are installed to. It must differ from the target's
+	VersionsPath string
+	// VersionScheme parses and orders the installed versions. New defaults
+	// it to the target's VersionScheme
+	VersionScheme VersionScheme
+}
+
+// LatestVersion returns the latest version installed of the component. A
+// component without a VersionScheme is ordered by FourPartVersionScheme, the
+// target's scheme is only applied by New
+func (component Component) LatestVersion() string {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	return latestInstalledVersion(
+		component.VersionsPath,
+		component.versionScheme(),
+		badVersionSet(component.VersionsPath, log),
+		nil,
+		log)
+}
+
+// versionScheme returns the scheme of the component, FourPartVersionScheme
+// if none is set
+func (component Component) versionScheme() VersionScheme {
+	if component.VersionScheme == nil {
+		return FourPartVersionScheme{}
+	}
+	return component.VersionScheme
+}
+
+// installation is an application installed into versioned directories, the
+// target or one of its components
+type installation struct {
+	appID        string
+	channel      string
+	versionsPath string
+	scheme       VersionScheme
+	// binaryName is the name raw binary packages are installed as, only set
+	// for the target
+	binaryName string
+	// component is false for the target
+	component bool
+}
+
+// availableUpdate is the manifest of an update available for an installation
+type availableUpdate struct {
+	installation installation
+	manifest     omaha.Manifest
+	// rollback is set for a rollback flagged by the server to a version
+	// that is not newer than the installed version
+	rollback bool
+}
+
+// isInstalled returns true if the version of the update is installed
+func (updater *Unattended) isInstalled(update availableUpdate) bool {
+	info, err := os.Stat(filepath.Join(update.installation.versionsPath, update.manifest.Version))
+	return err == nil && info.IsDir()
+}
+
+// latestVersion returns the latest installed version, skipping bad versions
+func (updater *Unattended) latestVersion(installation installation) string {
+	return updater.latestVersionBefore(installation, nil)
+}
+
+// latestVersionBefore returns the latest installed version older than the
+// version, skipping bad versions
+func (updater *Unattended) latestVersionBefore(installation installation, before Version) string {
+	return latestInstalledVersion(
+		installation.versionsPath,
+		installation.scheme,
+		updater.badVersions(installation),
+		before,
+		updater.log)
+}
+
+// badVersions returns the bad versions of the installation as a set
+func (updater *Unattended) badVersions(installation installation) map[string]bool {
+	return badVersionSet(installation.versionsPath, updater.log)
+}
+
+// targetInstallation returns the installation of the target
+func (updater *Unattended) targetInstallation() installation {
+	return installation{
+		appID:        updater.target.AppID,
+		channel:      updater.target.UpdateChannel,
+		versionsPath: updater.target.VersionsPath,
+		scheme:       updater.target.versionScheme(),
+		binaryName:   updater.target.ApplicationName,
+	}
+}
+
+// latestVersions returns the latest installed versions of the target and
+// its components, joined to be compared
+func (updater *Unattended) latestVersions() string {
+	var versions []string
+	for _, installation := range updater.installations() {
+		versions = append(versions, updater.latestVersion(installation))
+	}
+	return strings.Join(versions, ",")
+}
+
+// installations returns the target and its components
+func (updater *Unattended) installations() []installation {
+	installations := []installation{updater.targetInstallation()}
+	for _, component := range updater.target.Components {
+		installations = append(installations, installation{
+			appID:        component.AppID,
+			channel:      component.UpdateChannel,
+			versionsPath: component.VersionsPath,
+			scheme:       component.VersionScheme,
+			component:    true,
+		})
+	}
+	return installations
+}
+
+// validateComponents checks the components of the target and applies the
+// target's defaults
+func validateComponents(target *Target) error {
+	appIDs := map[string]bool{target.AppID: true}
+	for i := range target.Components {
+		component := &target.Components[i]
+		if component.AppID == "" {
+			return fmt.Errorf("Component %d has no AppID", i)
+		}
+		if appIDs[component.AppID] {
+			return fmt.Errorf("Component AppID '%s' is not unique", component.AppID)
+		}
+		appIDs[component.AppID] = true
+
+		if component.VersionsPath == "" ||
+			filepath.Clean(component.VersionsPath) == filepath.Clean(target.VersionsPath) {
+			return fmt.Errorf(
+				"Component '%s' version path '%s' is not valid",
+				component.AppID,
+				component.VersionsPath)
+		}
+		if component.UpdateChannel == "" {
+			component.UpdateChannel = target.UpdateChannel
+		}
+		if component.VersionScheme == nil {
+			component.VersionScheme = target.versionScheme()
+		}
+	}
+	return nil
+}
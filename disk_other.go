@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// freeDiskSpace is not supported on this platform
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("Free disk space is not available on %s", runtime.GOOS)
+}
@@ -0,0 +1,363 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultExtractionHeadroom is the extraction headroom used if none is
+	// set on the target
+	DefaultExtractionHeadroom = 2.0
+	// DefaultDownloadRetries is the number of download retries used if none
+	// is set on the target
+	DefaultDownloadRetries = 5
+	// DefaultDownloadBackoff is the delay before the first download retry
+	// used if none is set on the target
+	DefaultDownloadBackoff = time.Second * 2
+
+	// maxDownloadBackoff is the maximum delay between download retries
+	maxDownloadBackoff = time.Minute
+	// downloadBackoffJitter is the fraction the retry delay is randomly
+	// changed by
+	downloadBackoffJitter = 0.2
+	// downloadsDirectoryName is the directory in the state directory holding
+	// partial downloads
+	downloadsDirectoryName = "downloads"
+	// downloadStateExtension is the extension of the state of a partial
+	// download
+	downloadStateExtension = ".json"
+)
+
+// checkDiskSpace returns an error if the filesystem of the path has less
+// free space than the package size plus the extraction headroom
+func (updater *Unattended) checkDiskSpace(path string, size int64) error {
+	required := uint64(float64(size) * (1 + updater.target.ExtractionHeadroom))
+	available, err := freeDiskSpace(path)
+	if err != nil {
+		updater.log.WithField(
+			"path", path,
+		).Debugf("Unable to check free disk space: %s", err)
+		return nil
+	}
+
+	updater.log.WithFields(logrus.Fields{
+		"path":      path,
+		"available": available,
+		"required":  required,
+	}).Debug("Checked free disk space")
+	if available < required {
+		return fmt.Errorf(
+			"Insufficient disk space, %d bytes available and %d bytes required",
+			available,
+			required)
+	}
+	return nil
+}
+
+// downloadFile downloads the URL to the path. The download is kept in the
+// state directory under the key until it completes, and is resumed by later
+// calls. Transient failures are retried with exponential backoff. The
+// download is aborted as soon as it exceeds maxSize. If declaredSize is set
+// the downloaded size must match it
+func (updater *Unattended) downloadFile(
+	ctx context.Context,
+	url string,
+	key string,
+	path string,
+	declaredSize int64,
+	maxSize int64,
+	tracker *progressTracker) error {
+
+	partialPath := updater.target.statePath(filepath.Join(downloadsDirectoryName, key))
+	err := os.MkdirAll(filepath.Dir(partialPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	retryPolicy := RestartPolicy{
+		InitialBackoff: updater.target.DownloadBackoff,
+		MaxBackoff:     maxDownloadBackoff,
+		Jitter:         downloadBackoffJitter,
+	}
+	for attempt := 0; ; attempt++ {
+		err = updater.downloadAttempt(ctx, url, partialPath, declaredSize, maxSize, tracker)
+		if err == nil {
+			break
+		}
+		transient, ok := err.(*transientError)
+		if ok == false || attempt >= updater.target.DownloadRetries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := retryPolicy.backoff(attempt)
+		updater.log.WithFields(logrus.Fields{
+			"url":     url,
+			"attempt": attempt + 1,
+			"delay":   delay,
+		}).Warningf("Download failed, retrying: %s", transient.err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+
+	tracker.finish()
+	os.Remove(partialPath + downloadStateExtension)
+	return os.Rename(partialPath, path)
+}
+
+// downloadAttempt downloads the URL to the partial path, resuming the
+// partial download if the server still has the same content
+func (updater *Unattended) downloadAttempt(
+	ctx context.Context,
+	url string,
+	partialPath string,
+	declaredSize int64,
+	maxSize int64,
+	tracker *progressTracker) error {
+
+	var offset int64
+	state := readDownloadState(partialPath)
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// The server sends the full content if it changed
+		if state.ETag != "" {
+			request.Header.Set("If-Range", state.ETag)
+		} else if state.LastModified != "" {
+			request.Header.Set("If-Range", state.LastModified)
+		}
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return &transientError{err: err}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusPartialContent && offset > 0:
+		if state.changed(response) || contentRangeStart(response) != offset {
+			discardDownload(partialPath)
+			return &transientError{err: fmt.Errorf("Package changed on the server")}
+		}
+	case response.StatusCode == http.StatusOK:
+		offset = 0
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		if offset == declaredSize {
+			return nil
+		}
+		discardDownload(partialPath)
+		return &transientError{err: fmt.Errorf("Partial download is not valid")}
+	case response.StatusCode >= 500 ||
+		response.StatusCode == http.StatusRequestTimeout ||
+		response.StatusCode == http.StatusTooManyRequests:
+		return &transientError{err: fmt.Errorf("Received HTTP status code %d", response.StatusCode)}
+	default:
+		return fmt.Errorf("Received HTTP status code %d", response.StatusCode)
+	}
+
+	if response.ContentLength >= 0 && offset+response.ContentLength > maxSize {
+		discardDownload(partialPath)
+		return fmt.Errorf(
+			"Package of %d bytes exceeds the size of %d bytes",
+			offset+response.ContentLength,
+			maxSize)
+	}
+
+	state = downloadState{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+	}
+	err = state.write(partialPath)
+	if err != nil {
+		return err
+	}
+
+	total := int64(0)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	}
+	tracker.start(offset, total)
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partialPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	// Never write more than one byte past the maximum size
+	written, err := io.Copy(
+		io.MultiWriter(file, tracker),
+		io.LimitReader(updater.limitDownload(ctx, response.Body), maxSize-offset+1))
+	closeErr := file.Close()
+	if err == ErrOutsideDownloadWindow {
+		return err
+	}
+	if err != nil {
+		// The partial download is kept to be resumed
+		return &transientError{err: err}
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	size := offset + written
+	if size > maxSize {
+		discardDownload(partialPath)
+		return fmt.Errorf("Package exceeds the size of %d bytes", maxSize)
+	}
+	if declaredSize != 0 && size < declaredSize {
+		return &transientError{err: fmt.Errorf(
+			"Download ended after %d of %d bytes",
+			size,
+			declaredSize)}
+	}
+	if declaredSize != 0 && size != declaredSize {
+		discardDownload(partialPath)
+		return fmt.Errorf(
+			"Package size is %d bytes, expected %d bytes",
+			size,
+			declaredSize)
+	}
+	return nil
+}
+
+// downloadKey returns the name the download of the package is kept under,
+// the package's hash or the hash of its URL if it has none
+func downloadKey(manifest omaha.Manifest) string {
+	hash := strings.ToLower(manifest.Package.SHA256Hash)
+	if _, err := hex.DecodeString(hash); err == nil && len(hash) == sha256.Size*2 {
+		return hash
+	}
+	digest := sha256.Sum256([]byte(manifest.DownloadURL.Codebase))
+	return hex.EncodeToString(digest[:])
+}
+
+// pruneDownloads removes the partial downloads of packages that are no
+// longer offered
+func (updater *Unattended) pruneDownloads(manifests []omaha.Manifest) {
+	keep := make(map[string]bool)
+	for _, manifest := range manifests {
+		keep[downloadKey(manifest)] = true
+	}
+
+	downloadsPath := updater.target.statePath(downloadsDirectoryName)
+	files, err := ioutil.ReadDir(downloadsPath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		key := strings.TrimSuffix(file.Name(), downloadStateExtension)
+		if keep[key] {
+			continue
+		}
+		updater.log.WithField(
+			"download", file.Name(),
+		).Debug("Removing stale partial download")
+		os.Remove(filepath.Join(downloadsPath, file.Name()))
+	}
+}
+
+// transientError is a download failure that is worth retrying
+type transientError struct {
+	err error
+}
+
+// Error returns the description of the failure
+func (err *transientError) Error() string {
+	return err.err.Error()
+}
+
+// downloadState is persisted next to a partial download to detect if the
+// content on the server changed before resuming
+type downloadState struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// readDownloadState reads the state of the partial download
+func readDownloadState(partialPath string) downloadState {
+	var state downloadState
+	content, err := ioutil.ReadFile(partialPath + downloadStateExtension)
+	if err == nil {
+		json.Unmarshal(content, &state)
+	}
+	return state
+}
+
+// write persists the state of the partial download
+func (state downloadState) write(partialPath string) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(partialPath+downloadStateExtension, content)
+}
+
+// changed returns true if the validators of the response differ from the
+// validators of the partial download
+func (state downloadState) changed(response *http.Response) bool {
+	if state.ETag != "" {
+		return response.Header.Get("ETag") != state.ETag
+	}
+	if state.LastModified != "" {
+		return response.Header.Get("Last-Modified") != state.LastModified
+	}
+	return false
+}
+
+// contentRangeStart returns the first byte of a partial response, or -1 if
+// the Content-Range header is not valid
+func contentRangeStart(response *http.Response) int64 {
+	var start, end int64
+	_, err := fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// discardDownload removes the partial download and its state
+func discardDownload(partialPath string) {
+	os.Remove(partialPath)
+	os.Remove(partialPath + downloadStateExtension)
+}
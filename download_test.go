@@ -0,0 +1,205 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadAttemptResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// partial is the content downloaded before, with the ETag it was
+		// downloaded with
+		partial string
+		etag    string
+		// The response of the server
+		status       int
+		serverETag   string
+		contentRange string
+		body         string
+		chunked      bool
+		// declaredSize and maxSize of the package
+		declaredSize int64
+		maxSize      int64
+		// content is the expected content of the partial download, nil if
+		// it was discarded
+		content   *string
+		err       bool
+		transient bool
+	}{
+		{
+			name:         "resumed",
+			partial:      "hello ",
+			etag:         `"v1"`,
+			status:       http.StatusPartialContent,
+			serverETag:   `"v1"`,
+			contentRange: "bytes 6-10/11",
+			body:         "world",
+			declaredSize: 11,
+			maxSize:      11,
+			content:      stringPointer("hello world"),
+		},
+		{
+			name:         "restarted after the package changed",
+			partial:      "hello ",
+			etag:         `"v1"`,
+			status:       http.StatusOK,
+			serverETag:   `"v2"`,
+			body:         "HELLO WORLD",
+			declaredSize: 11,
+			maxSize:      11,
+			content:      stringPointer("HELLO WORLD"),
+		},
+		{
+			name:         "partial content of a changed package",
+			partial:      "hello ",
+			etag:         `"v1"`,
+			status:       http.StatusPartialContent,
+			serverETag:   `"v2"`,
+			contentRange: "bytes 6-10/11",
+			body:         "WORLD",
+			declaredSize: 11,
+			maxSize:      11,
+			err:          true,
+			transient:    true,
+		},
+		{
+			name:         "range not satisfiable once complete",
+			partial:      "hello world",
+			etag:         `"v1"`,
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			declaredSize: 11,
+			maxSize:      11,
+			content:      stringPointer("hello world"),
+		},
+		{
+			name:         "range not satisfiable",
+			partial:      "hello ",
+			etag:         `"v1"`,
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			declaredSize: 11,
+			maxSize:      11,
+			err:          true,
+			transient:    true,
+		},
+		{
+			name:         "declared size overrun",
+			status:       http.StatusOK,
+			body:         "hello world, and more",
+			declaredSize: 11,
+			maxSize:      11,
+			err:          true,
+		},
+		{
+			name:         "streamed size overrun",
+			status:       http.StatusOK,
+			body:         "hello world, and more",
+			chunked:      true,
+			declaredSize: 11,
+			maxSize:      11,
+			err:          true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				expectedRange := ""
+				expectedIfRange := ""
+				if test.partial != "" {
+					expectedRange = fmt.Sprintf("bytes=%d-", len(test.partial))
+					expectedIfRange = test.etag
+				}
+				if r.Header.Get("Range") != expectedRange {
+					t.Errorf("Expected Range '%s', got '%s'", expectedRange, r.Header.Get("Range"))
+				}
+				if r.Header.Get("If-Range") != expectedIfRange {
+					t.Errorf("Expected If-Range '%s', got '%s'", expectedIfRange, r.Header.Get("If-Range"))
+				}
+
+				if test.serverETag != "" {
+					w.Header().Set("ETag", test.serverETag)
+				}
+				if test.contentRange != "" {
+					w.Header().Set("Content-Range", test.contentRange)
+				}
+				w.WriteHeader(test.status)
+				if test.chunked {
+					// Flushing before the body is written leaves the length unknown
+					w.(http.Flusher).Flush()
+				}
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			updater := newTestUpdater(t, Target{})
+			partialPath := filepath.Join(t.TempDir(), "package")
+			if test.partial != "" {
+				err := ioutil.WriteFile(partialPath, []byte(test.partial), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = downloadState{ETag: test.etag}.write(partialPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tracker := updater.newProgressTracker("package", "1.0.0.0", test.declaredSize)
+			err := updater.downloadAttempt(
+				context.Background(),
+				server.URL,
+				partialPath,
+				test.declaredSize,
+				test.maxSize,
+				tracker)
+			if test.err && err == nil {
+				t.Fatal("Expected an error")
+			}
+			if test.err == false && err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if _, transient := err.(*transientError); transient != test.transient {
+				t.Fatalf("Expected transient %t, got %v", test.transient, err)
+			}
+
+			content, err := ioutil.ReadFile(partialPath)
+			if test.content == nil {
+				if os.IsNotExist(err) == false {
+					t.Fatalf("Expected the partial download to be discarded, got '%s'", content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != *test.content {
+				t.Fatalf("Expected '%s', got '%s'", *test.content, content)
+			}
+		})
+	}
+}
+
+// stringPointer returns a pointer to the string
+func stringPointer(value string) *string {
+	return &value
+}
@@ -0,0 +1,313 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventTimeout is the time allowed for delivering a queued event
+	eventTimeout = time.Second * 10
+	// eventsFileName is the state file queueing events until delivered
+	eventsFileName = "events.json"
+	// maxQueuedEvents is the number of events kept while the server is not
+	// reachable, the oldest events are dropped first
+	maxQueuedEvents = 100
+)
+
+const (
+	// EventErrorCodeDownload is reported when downloading or verifying a
+	// package failed
+	EventErrorCodeDownload = 1
+	// EventErrorCodeInstall is reported when installing a package failed
+	EventErrorCodeInstall = 2
+	// EventErrorCodeStart is reported when a new version failed to start
+	EventErrorCodeStart = 3
+	// EventErrorCodeProbation is reported when a new version exited or was
+	// unhealthy during probation
+	EventErrorCodeProbation = 4
+)
+
+// queuedEvent is an event waiting to be delivered to the update endpoint
+type queuedEvent struct {
+	ID              string `json:"id"`
+	AppID           string `json:"app_id"`
+	Channel         string `json:"channel"`
+	Version         string `json:"version"`
+	Type            string `json:"type"`
+	Result          string `json:"result"`
+	ErrorCode       int    `json:"error_code,omitempty"`
+	PreviousVersion string `json:"previous_version,omitempty"`
+	NextVersion     string `json:"next_version,omitempty"`
+	Downloaded      uint64 `json:"downloaded,omitempty"`
+	Total           uint64 `json:"total,omitempty"`
+}
+
+// request returns the Omaha request reporting the event
+func (event queuedEvent) request() omaha.Request {
+	return omaha.Request{
+		Protocol: 3,
+		Applications: []omaha.App{{
+			Channel: event.Channel,
+			ID:      event.AppID,
+			Version: event.Version,
+			Event: omaha.Event{
+				Type:            event.Type,
+				Result:          event.Result,
+				ErrorCode:       event.ErrorCode,
+				PreviousVersion: event.PreviousVersion,
+				NextVersion:     event.NextVersion,
+				Downloaded:      event.Downloaded,
+				Total:           event.Total,
+			},
+		}},
+	}
+}
+
+// reportEvent queues the event for the given version of the installation
+// and delivers the queued events to the update endpoint in the background.
+// Events that can't be delivered stay queued on disk until the server is
+// reachable again
+func (updater *Unattended) reportEvent(
+	installation installation,
+	version string,
+	event omaha.Event) {
+
+	updater.log.WithFields(logrus.Fields{
+		"app_id":       installation.appID,
+		"version":      version,
+		"event_type":   event.Type,
+		"event_result": event.Result,
+	}).Debug("Reporting event")
+
+	id, err := newUUID()
+	if err != nil {
+		updater.log.Warningf("Unable to queue event: %s", err)
+		return
+	}
+	updater.eventsMutex.Lock()
+	events := append(updater.queuedEvents(), queuedEvent{
+		ID:              id,
+		AppID:           installation.appID,
+		Channel:         installation.channel,
+		Version:         version,
+		Type:            event.Type,
+		Result:          event.Result,
+		ErrorCode:       event.ErrorCode,
+		PreviousVersion: event.PreviousVersion,
+		NextVersion:     event.NextVersion,
+		Downloaded:      event.Downloaded,
+		Total:           event.Total,
+	})
+	if len(events) > maxQueuedEvents {
+		updater.log.WithField(
+			"dropped", len(events)-maxQueuedEvents,
+		).Warning("Too many undelivered events, dropping the oldest")
+		events = events[len(events)-maxQueuedEvents:]
+	}
+	err = updater.saveEvents(events)
+	updater.eventsMutex.Unlock()
+	if err != nil {
+		updater.log.Warningf("Unable to queue event: %s", err)
+	}
+
+	updater.startDelivery()
+}
+
+// beginDeliveries derives the context of the event deliveries from the
+// context the target runs with
+func (updater *Unattended) beginDeliveries(ctx context.Context) {
+	updater.eventsMutex.Lock()
+	defer updater.eventsMutex.Unlock()
+	if updater.cancelDeliveries != nil {
+		updater.cancelDeliveries()
+	}
+	updater.deliveryContext, updater.cancelDeliveries = context.WithCancel(ctx)
+}
+
+// stopDeliveries cancels the running event delivery and waits for it to
+// return. Undelivered events stay queued, no delivery is started until
+// beginDeliveries is called again
+func (updater *Unattended) stopDeliveries() {
+	updater.eventsMutex.Lock()
+	if updater.cancelDeliveries == nil {
+		updater.deliveryContext, updater.cancelDeliveries = context.WithCancel(context.Background())
+	}
+	updater.cancelDeliveries()
+	updater.eventsMutex.Unlock()
+
+	updater.deliveries.Wait()
+}
+
+// startDelivery delivers the queued events in the background. Only one
+// delivery runs at a time, a delivery started while one is running is done
+// once it completed
+func (updater *Unattended) startDelivery() {
+	updater.eventsMutex.Lock()
+	defer updater.eventsMutex.Unlock()
+	if updater.deliveringEvents {
+		updater.deliverEventsAgain = true
+		return
+	}
+	ctx := updater.deliveryContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	updater.deliveringEvents = true
+
+	updater.deliveries.Add(1)
+	go func() {
+		defer updater.deliveries.Done()
+		for {
+			updater.deliverEvents(ctx)
+
+			updater.eventsMutex.Lock()
+			if updater.deliverEventsAgain == false {
+				updater.deliveringEvents = false
+				updater.eventsMutex.Unlock()
+				return
+			}
+			updater.deliverEventsAgain = false
+			updater.eventsMutex.Unlock()
+		}
+	}()
+}
+
+// deliverEvents sends the queued events in order, stopping at the first
+// event that can't be delivered. The queue is only locked to read and
+// update it, events are queued while the requests are sent
+func (updater *Unattended) deliverEvents(ctx context.Context) {
+	updater.eventsMutex.Lock()
+	events := updater.queuedEvents()
+	updater.eventsMutex.Unlock()
+
+	delivered := make(map[string]bool)
+	for _, event := range events {
+		eventCtx, cancel := context.WithTimeout(ctx, eventTimeout)
+		_, err := updater.sendRequest(eventCtx, event.request())
+		cancel()
+		if err != nil {
+			updater.log.WithField(
+				"queued", len(events)-len(delivered),
+			).Warningf("Unable to deliver events, retrying later: %s", err)
+			break
+		}
+		delivered[event.ID] = true
+	}
+	if len(delivered) == 0 {
+		return
+	}
+
+	updater.eventsMutex.Lock()
+	defer updater.eventsMutex.Unlock()
+	var remaining []queuedEvent
+	for _, event := range updater.queuedEvents() {
+		if delivered[event.ID] == false {
+			remaining = append(remaining, event)
+		}
+	}
+	err := updater.saveEvents(remaining)
+	if err != nil {
+		updater.log.Warningf("Unable to update event queue: %s", err)
+	}
+}
+
+// queuedEvents returns the events waiting to be delivered
+func (updater *Unattended) queuedEvents() []queuedEvent {
+	var events []queuedEvent
+	content, err := ioutil.ReadFile(updater.target.statePath(eventsFileName))
+	if err != nil {
+		return events
+	}
+	err = json.Unmarshal(content, &events)
+	if err != nil {
+		updater.log.Warningf("Unable to read queued events: %s", err)
+	}
+	return events
+}
+
+// saveEvents writes the events waiting to be delivered to disk
+func (updater *Unattended) saveEvents(events []queuedEvent) error {
+	path := updater.target.statePath(eventsFileName)
+	if len(events) == 0 {
+		err := os.Remove(path)
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+		return nil
+	}
+	content, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// reportDownloadEvent reports the download of the package in the manifest
+// with the bytes downloaded so far
+func (updater *Unattended) reportDownloadEvent(
+	installation installation,
+	manifest omaha.Manifest,
+	result string,
+	progress DownloadProgress) {
+
+	version := updater.latestVersion(installation)
+	event := omaha.Event{
+		Type:            omaha.EventTypeDownload,
+		Result:          result,
+		PreviousVersion: version,
+		NextVersion:     manifest.Version,
+	}
+	if progress.BytesDone > 0 {
+		event.Downloaded = uint64(progress.BytesDone)
+	}
+	if progress.BytesTotal > 0 {
+		event.Total = uint64(progress.BytesTotal)
+	}
+	if result == omaha.EventResultTypeError {
+		event.ErrorCode = EventErrorCodeDownload
+	}
+	updater.reportEvent(installation, version, event)
+}
+
+// reportInstallEvent reports the installation of the package in the
+// manifest, previousVersion is the version the package was installed over
+func (updater *Unattended) reportInstallEvent(
+	installation installation,
+	previousVersion string,
+	manifest omaha.Manifest,
+	result string) {
+
+	event := omaha.Event{
+		Type:            omaha.EventTypeInstall,
+		Result:          result,
+		PreviousVersion: previousVersion,
+		NextVersion:     manifest.Version,
+	}
+	if result == omaha.EventResultTypeError {
+		event.ErrorCode = EventErrorCodeInstall
+	}
+	updater.reportEvent(installation, previousVersion, event)
+}
@@ -0,0 +1,47 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+func TestQueuedEventRequestHasNoUpdateCheck(t *testing.T) {
+	events := []queuedEvent{
+		{AppID: "app", Version: "1.0.0.0", Type: omaha.EventTypeDownload, Result: omaha.EventResultTypeStarted},
+		{AppID: "app", Version: "1.0.0.0", Type: omaha.EventTypeInstall, Result: omaha.EventResultTypeSuccess},
+		{AppID: "app", Version: "2.0.0.0", Type: omaha.EventTypeRollback, Result: omaha.EventResultTypeSuccess, ErrorCode: 4},
+	}
+
+	for _, event := range events {
+		content, err := xml.Marshal(event.request())
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := string(content)
+		if strings.Contains(request, "<updatecheck") {
+			t.Fatalf("Expected no update check in the event request, got %s", request)
+		}
+		if strings.Contains(request, "<reason") {
+			t.Fatalf("Expected no reason in the event request, got %s", request)
+		}
+		if strings.Contains(request, `eventtype="`+event.Type+`"`) == false {
+			t.Fatalf("Expected the event in the request, got %s", request)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -45,7 +46,7 @@ func main() {
 		panic(err)
 	}
 	//
-	// updated, err := updater.ApplyUpdates()
+	// updated, err := updater.ApplyUpdates(context.Background())
 	// if err != nil {
 	// 	panic(err)
 	// }
@@ -55,19 +56,14 @@ func main() {
 	// 	fmt.Println("NOTUPDATED")
 	// }
 
-	go func() {
+	// Cancelling the context stops the update checks and the target
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*8)
+	defer cancel()
 
-		err = updater.Run()
-		if err != nil {
-			// TODO: LOG!
-			fmt.Println("Run error: ", err)
-		}
-	}()
-
-	time.Sleep(time.Second * 8)
-	fmt.Println("Stopping")
-	err = updater.Stop()
+	err = updater.Run(ctx)
 	if err != nil {
-		panic(err)
+		// TODO: LOG!
+		fmt.Println("Run error: ", err)
 	}
+	fmt.Println("Stopped")
 }
@@ -0,0 +1,569 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxExtractedSize is the maximum total size of a package's
+	// extracted files used if none is set on the target
+	DefaultMaxExtractedSize = 4 << 30
+	// DefaultMaxExtractedFileSize is the maximum size of a single extracted
+	// file used if none is set on the target
+	DefaultMaxExtractedFileSize = 2 << 30
+	// DefaultMaxExtractedFiles is the maximum number of entries in a package
+	// used if none is set on the target
+	DefaultMaxExtractedFiles = 100000
+
+	// paxXattrPrefix is the prefix of the PAX records holding extended
+	// attributes
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+var (
+	// ErrAbsolutePath is the reason for rejecting an entry with an absolute
+	// path
+	ErrAbsolutePath = errors.New("Absolute paths are not allowed")
+	// ErrPathTraversal is the reason for rejecting an entry that would be
+	// written outside of the version directory
+	ErrPathTraversal = errors.New("Path escapes the version directory")
+	// ErrUnsafeLink is the reason for rejecting a link pointing outside of
+	// the version directory
+	ErrUnsafeLink = errors.New("Link target escapes the version directory")
+	// ErrUnsupportedEntry is the reason for rejecting device nodes and FIFOs
+	ErrUnsupportedEntry = errors.New("Entry type is not allowed")
+	// ErrLimitExceeded is the reason for rejecting a package that exceeds
+	// the extraction limits
+	ErrLimitExceeded = errors.New("Extraction limit exceeded")
+)
+
+// ExtractionError is returned when an entry of a package is rejected during
+// extraction. Reason is one of the Err* reasons
+type ExtractionError struct {
+	// Entry is the name of the rejected entry in the package
+	Entry string
+	// Reason the entry was rejected
+	Reason error
+	// Detail about the rejection
+	Detail string
+}
+
+// Error returns the description of the rejection
+func (err *ExtractionError) Error() string {
+	if err.Detail == "" {
+		return fmt.Sprintf("Rejected package entry '%s': %s", err.Entry, err.Reason)
+	}
+	return fmt.Sprintf(
+		"Rejected package entry '%s': %s: %s",
+		err.Entry,
+		err.Reason,
+		err.Detail)
+}
+
+// Unwrap returns the reason, allowing errors.Is(err, ErrPathTraversal)
+func (err *ExtractionError) Unwrap() error {
+	return err.Reason
+}
+
+// ExtractionLimits protects against packages that expand beyond reasonable
+// sizes, also known as decompression bombs
+type ExtractionLimits struct {
+	// MaxTotalSize is the maximum size in bytes of all extracted files,
+	// defaults to DefaultMaxExtractedSize
+	MaxTotalSize int64
+	// MaxFileSize is the maximum size in bytes of a single extracted file,
+	// defaults to DefaultMaxExtractedFileSize
+	MaxFileSize int64
+	// MaxFiles is the maximum number of entries in a package, defaults to
+	// DefaultMaxExtractedFiles
+	MaxFiles int
+}
+
+// safeExtractor writes package entries into a version directory, rejecting
+// any entry that would escape the directory or exceed the limits
+type safeExtractor struct {
+	root         string
+	resolvedRoot string
+	limits       ExtractionLimits
+	totalSize    int64
+	files        int
+	// ignorePermissions normalises the permissions of the entries
+	ignorePermissions bool
+	// preserveOwnership applies the owner, setuid and setgid bits and
+	// extended attributes of the entries, only possible when running as root
+	preserveOwnership bool
+	directories       []extractedDirectory
+	log               *logrus.Entry
+}
+
+// extractedDirectory is a directory entry whose metadata is applied once all
+// entries are extracted
+type extractedDirectory struct {
+	path   string
+	header *tar.Header
+}
+
+// newSafeExtractor creates an extractor for the version directory
+func newSafeExtractor(
+	root string,
+	limits ExtractionLimits,
+	ignorePermissions bool,
+	preserveOwnership bool,
+	log *logrus.Entry) (*safeExtractor, error) {
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	resolvedRoot, err = filepath.Abs(resolvedRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &safeExtractor{
+		root:              root,
+		resolvedRoot:      resolvedRoot,
+		limits:            limits,
+		ignorePermissions: ignorePermissions,
+		preserveOwnership: preserveOwnership && os.Geteuid() == 0,
+		log:               log,
+	}, nil
+}
+
+// extractTarEntry extracts a single entry of a tar archive
+func (extractor *safeExtractor) extractTarEntry(header *tar.Header, reader io.Reader) error {
+	// get the filename in the archive
+	filename := header.Name
+
+	extractor.files++
+	if extractor.files > extractor.limits.MaxFiles {
+		return &ExtractionError{
+			Entry:  filename,
+			Reason: ErrLimitExceeded,
+			Detail: fmt.Sprintf("more than %d entries", extractor.limits.MaxFiles),
+		}
+	}
+
+	destinationPath, err := extractor.destinationPath(filename)
+	if err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// An existing directory may be a symlink copied from the previous
+		// version
+		if extractor.isInside(destinationPath) == false {
+			return &ExtractionError{
+				Entry:  filename,
+				Reason: ErrPathTraversal,
+				Detail: "through a symlink",
+			}
+		}
+		// Create directories if needed. The permissions are applied once all
+		// entries are extracted, a read-only directory must still be
+		// writable for the entries inside it
+		err := os.MkdirAll(destinationPath, 0755)
+		if err != nil {
+			return err
+		}
+		extractor.directories = append(extractor.directories, extractedDirectory{
+			path:   destinationPath,
+			header: header,
+		})
+	case tar.TypeReg:
+		err := extractor.writeFile(
+			filename,
+			destinationPath,
+			header.Size,
+			reader)
+		if err != nil {
+			return err
+		}
+		return extractor.applyMetadata(destinationPath, header)
+	case tar.TypeSymlink:
+		err := extractor.checkSymlink(filename, destinationPath, header.Linkname)
+		if err != nil {
+			return err
+		}
+		err = extractor.prepareDestination(destinationPath)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(filepath.FromSlash(header.Linkname), destinationPath)
+		if err != nil {
+			return err
+		}
+		extractor.log.WithFields(logrus.Fields{
+			"path":   destinationPath,
+			"target": header.Linkname,
+		}).Debugf("Created symlink")
+		return extractor.applyOwnership(destinationPath, header)
+	case tar.TypeLink:
+		sourcePath, err := extractor.linkSource(filename, header.Linkname)
+		if err != nil {
+			return err
+		}
+		err = extractor.prepareDestination(destinationPath)
+		if err != nil {
+			return err
+		}
+		// The link shares the metadata of its source, nothing to apply
+		err = os.Link(sourcePath, destinationPath)
+		if err != nil {
+			return err
+		}
+		extractor.log.WithFields(logrus.Fields{
+			"path":   destinationPath,
+			"target": header.Linkname,
+		}).Debugf("Created hardlink")
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return &ExtractionError{
+			Entry:  filename,
+			Reason: ErrUnsupportedEntry,
+			Detail: fmt.Sprintf("type %c", header.Typeflag),
+		}
+	default:
+		extractor.log.Warningf("Unable to determine type, found: %c %s %s\n",
+			header.Typeflag,
+			"in file",
+			filename,
+		)
+	}
+	return nil
+}
+
+// finish applies the metadata of the extracted directories. Children are
+// handled before their parents, creating entries inside a directory changes
+// its modification time
+func (extractor *safeExtractor) finish() error {
+	for i := len(extractor.directories) - 1; i >= 0; i-- {
+		directory := extractor.directories[i]
+		err := extractor.applyMetadata(directory.path, directory.header)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile creates the file at the destination with the content of reader
+func (extractor *safeExtractor) writeFile(
+	name string,
+	destinationPath string,
+	size int64,
+	reader io.Reader) error {
+
+	if size > extractor.limits.MaxFileSize {
+		return &ExtractionError{
+			Entry:  name,
+			Reason: ErrLimitExceeded,
+			Detail: fmt.Sprintf("file larger than %d bytes", extractor.limits.MaxFileSize),
+		}
+	}
+	extractor.totalSize += size
+	if extractor.totalSize > extractor.limits.MaxTotalSize {
+		return &ExtractionError{
+			Entry:  name,
+			Reason: ErrLimitExceeded,
+			Detail: fmt.Sprintf("package larger than %d bytes", extractor.limits.MaxTotalSize),
+		}
+	}
+
+	err := extractor.prepareDestination(destinationPath)
+	if err != nil {
+		return err
+	}
+
+	// Create the new file in the destination path, the permissions are
+	// applied with the rest of the metadata
+	destinationFile, err := os.OpenFile(
+		destinationPath,
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		0600)
+	if err != nil {
+		return err
+	}
+	defer destinationFile.Close()
+
+	// Never write more than the entry claims to contain
+	written, err := io.Copy(destinationFile, io.LimitReader(reader, size+1))
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf(
+			"Written bytes differ from original file. Expected %d, wrote %d",
+			size,
+			written)
+	}
+	extractor.log.WithField(
+		"path", destinationPath,
+	).Debugf("Updated file")
+	return destinationFile.Close()
+}
+
+// prepareDestination creates the parent directories of the destination and
+// removes what the previous version left at the destination. Existing links
+// must be replaced, not written through
+func (extractor *safeExtractor) prepareDestination(destinationPath string) error {
+	// Archives don't always contain entries for the parent directories
+	err := os.MkdirAll(filepath.Dir(destinationPath), 0755)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(destinationPath)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Unable to replace directory '%s'", destinationPath)
+	}
+	return os.Remove(destinationPath)
+}
+
+// applyMetadata applies the permissions, ownership, extended attributes and
+// modification time of the entry to the extracted file or directory
+func (extractor *safeExtractor) applyMetadata(path string, header *tar.Header) error {
+	// Changing the owner clears the setuid and setgid bits, it must be done
+	// before the permissions are applied
+	err := extractor.applyOwnership(path, header)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, extractor.fileMode(header))
+	if err != nil {
+		return err
+	}
+
+	if extractor.preserveOwnership {
+		for key, value := range header.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) == false {
+				continue
+			}
+			name := strings.TrimPrefix(key, paxXattrPrefix)
+			err := setXattr(path, name, []byte(value))
+			if err != nil {
+				extractor.log.WithFields(logrus.Fields{
+					"path":  path,
+					"xattr": name,
+				}).Warningf("Unable to set extended attribute: %s", err)
+			}
+		}
+	}
+
+	if header.ModTime.IsZero() {
+		return nil
+	}
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+	return os.Chtimes(path, accessTime, header.ModTime)
+}
+
+// applyOwnership changes the owner of the path to the owner of the entry
+// when ownership is preserved
+func (extractor *safeExtractor) applyOwnership(path string, header *tar.Header) error {
+	if extractor.preserveOwnership == false {
+		return nil
+	}
+	err := os.Lchown(path, header.Uid, header.Gid)
+	if err != nil {
+		return fmt.Errorf("Unable to change owner of '%s': %s", path, err)
+	}
+	return nil
+}
+
+// fileMode returns the permissions to apply for the entry
+func (extractor *safeExtractor) fileMode(header *tar.Header) os.FileMode {
+	mode := header.FileInfo().Mode()
+	if extractor.ignorePermissions {
+		if mode.IsDir() || mode.Perm()&0111 != 0 {
+			return 0755
+		}
+		return 0644
+	}
+	// The setuid, setgid and sticky bits are only kept along with the owner
+	// of the entry
+	if extractor.preserveOwnership {
+		return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	return mode.Perm()
+}
+
+// linkSource returns the path of the existing file a hardlink entry links to
+func (extractor *safeExtractor) linkSource(name string, linkname string) (string, error) {
+	sourcePath, err := extractor.destinationPath(linkname)
+	if err != nil {
+		return "", &ExtractionError{Entry: name, Reason: ErrUnsafeLink, Detail: linkname}
+	}
+	info, err := os.Lstat(sourcePath)
+	if err != nil {
+		return "", &ExtractionError{
+			Entry:  name,
+			Reason: ErrUnsafeLink,
+			Detail: fmt.Sprintf("'%s' does not exist", linkname),
+		}
+	}
+	if info.IsDir() {
+		return "", &ExtractionError{
+			Entry:  name,
+			Reason: ErrUnsafeLink,
+			Detail: fmt.Sprintf("'%s' is a directory", linkname),
+		}
+	}
+	return sourcePath, nil
+}
+
+// destinationPath returns the path in the version directory for the name
+// of an entry. Names that are absolute or escape the version directory,
+// directly or through existing symlinks, are rejected
+func (extractor *safeExtractor) destinationPath(name string) (string, error) {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") ||
+		filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", &ExtractionError{Entry: name, Reason: ErrAbsolutePath}
+	}
+
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", &ExtractionError{Entry: name, Reason: ErrPathTraversal}
+	}
+
+	destinationPath := filepath.Join(extractor.root, cleaned)
+	if extractor.isInside(filepath.Dir(destinationPath)) == false {
+		return "", &ExtractionError{
+			Entry:  name,
+			Reason: ErrPathTraversal,
+			Detail: "through a symlink",
+		}
+	}
+	return destinationPath, nil
+}
+
+// checkSymlink rejects symlinks that point outside the version directory
+func (extractor *safeExtractor) checkSymlink(name string, destinationPath string, target string) error {
+	if filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return &ExtractionError{Entry: name, Reason: ErrUnsafeLink, Detail: target}
+	}
+	resolved, ok := resolveLinkTarget(filepath.Dir(destinationPath), target)
+	if ok == false || extractor.isInside(resolved) == false {
+		return &ExtractionError{Entry: name, Reason: ErrUnsafeLink, Detail: target}
+	}
+	return nil
+}
+
+// resolveLinkTarget resolves the target of a symlink in the directory one
+// part at a time, following the symlinks on the way like the kernel does.
+// Missing entries, files and symlinks can be replaced by later entries with
+// a different symlink, a '..' may only climb out of directories entered
+// since the last of them
+func resolveLinkTarget(directory string, target string) (string, bool) {
+	current, err := resolveExisting(directory)
+	if err != nil {
+		return "", false
+	}
+	// fixed is true while current only consists of existing directories,
+	// depth counts the directories entered since it became false
+	fixed := true
+	depth := 0
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if fixed == false {
+				if depth == 0 {
+					return "", false
+				}
+				depth--
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err == nil && info.IsDir() {
+			if fixed == false {
+				depth++
+			}
+			continue
+		}
+		fixed = false
+		depth = 0
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			// Dangling symlinks were checked when they were extracted
+			resolved, err := filepath.EvalSymlinks(current)
+			if err == nil {
+				current = resolved
+			}
+		}
+	}
+	return current, true
+}
+
+// isInside returns true if the path, after resolving the symlinks of the
+// parts that exist, is inside the version directory
+func (extractor *safeExtractor) isInside(path string) bool {
+	resolved, err := resolveExisting(path)
+	if err != nil {
+		return false
+	}
+	relative, err := filepath.Rel(extractor.resolvedRoot, resolved)
+	if err != nil {
+		return false
+	}
+	return relative != ".." &&
+		strings.HasPrefix(relative, ".."+string(filepath.Separator)) == false
+}
+
+// resolveExisting resolves the symlinks in the longest existing part of the
+// path and returns the absolute path
+func resolveExisting(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{resolved}, missing...)...), nil
+}
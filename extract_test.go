@@ -0,0 +1,362 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testEntry is an entry of a test archive
+type testEntry struct {
+	name     string
+	linkname string
+	body     string
+	typeflag byte
+	// mode defaults to 0755
+	mode int64
+	uid  int
+	gid  int
+}
+
+// writeTestTarGz writes the entries as a tar.gz package
+func writeTestTarGz(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Linkname: entry.linkname,
+			Typeflag: entry.typeflag,
+			Mode:     0755,
+			Uid:      entry.uid,
+			Gid:      entry.gid,
+			ModTime:  time.Unix(1500000000, 0),
+		}
+		if entry.mode != 0 {
+			header.Mode = entry.mode
+		}
+		if entry.typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.body))
+		}
+		err := tarWriter.WriteHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tarWriter.Write([]byte(entry.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestUpdater returns an updater for a target in a temporary directory
+func newTestUpdater(t *testing.T, target Target) *Unattended {
+	t.Helper()
+	if target.VersionsPath == "" {
+		target.VersionsPath = t.TempDir()
+	}
+	if target.ApplicationName == "" {
+		target.ApplicationName = "app"
+	}
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	updater, err := New("test", target, time.Hour, logrus.NewEntry(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updater
+}
+
+// extractTestPackage extracts the entries into a new version directory in
+// the versions path of the updater
+func extractTestPackage(t *testing.T, updater *Unattended, entries []testEntry) (string, error) {
+	t.Helper()
+	packagePath := filepath.Join(t.TempDir(), "package.tar.gz")
+	writeTestTarGz(t, packagePath, entries)
+	versionPath := filepath.Join(updater.target.VersionsPath, "1.0.0.0")
+	err := os.MkdirAll(versionPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extractor := tarExtractor{updater: updater, decompress: decompressGzip}
+	return versionPath, extractor.Extract(context.Background(), packagePath, versionPath)
+}
+
+func TestExtractSymlinkChains(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		reason  error
+	}{
+		{
+			name: "parent through symlink to version",
+			entries: []testEntry{
+				{name: "d", linkname: ".", typeflag: tar.TypeSymlink},
+				{name: "d/e", linkname: "..", typeflag: tar.TypeSymlink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "chained parents",
+			entries: []testEntry{
+				{name: "d", linkname: ".", typeflag: tar.TypeSymlink},
+				{name: "sub/", typeflag: tar.TypeDir},
+				{name: "sub/e", linkname: "../d", typeflag: tar.TypeSymlink},
+				{name: "k", linkname: "sub/e/..", typeflag: tar.TypeSymlink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "parent of replaceable entry",
+			entries: []testEntry{
+				{name: "e", linkname: "x/..", typeflag: tar.TypeSymlink},
+				{name: "x", linkname: ".", typeflag: tar.TypeSymlink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "links inside the version",
+			entries: []testEntry{
+				{name: "lib/libfoo.so.1", body: "so", typeflag: tar.TypeReg},
+				{name: "lib/libfoo.so", linkname: "libfoo.so.1", typeflag: tar.TypeSymlink},
+				{name: "bin/lib", linkname: "../lib", typeflag: tar.TypeSymlink},
+				{name: "current", linkname: ".", typeflag: tar.TypeSymlink},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updater := newTestUpdater(t, Target{})
+			_, err := extractTestPackage(t, updater, test.entries)
+			if test.reason == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				return
+			}
+			if errors.Is(err, test.reason) == false {
+				t.Fatalf("Expected %s, got %v", test.reason, err)
+			}
+		})
+	}
+}
+
+func TestExtractRejections(t *testing.T) {
+	zeros := string(make([]byte, 1<<20))
+	tests := []struct {
+		name    string
+		limits  ExtractionLimits
+		setup   func(t *testing.T, versionPath string, outside string)
+		entries []testEntry
+		reason  error
+	}{
+		{
+			name: "absolute path",
+			entries: []testEntry{
+				{name: "/evil", body: "evil", typeflag: tar.TypeReg},
+			},
+			reason: ErrAbsolutePath,
+		},
+		{
+			name: "parent directory",
+			entries: []testEntry{
+				{name: "../evil", body: "evil", typeflag: tar.TypeReg},
+			},
+			reason: ErrPathTraversal,
+		},
+		{
+			name: "parent directory after a subdirectory",
+			entries: []testEntry{
+				{name: "a/../../evil", body: "evil", typeflag: tar.TypeReg},
+			},
+			reason: ErrPathTraversal,
+		},
+		{
+			name: "file through an existing symlink",
+			setup: func(t *testing.T, versionPath string, outside string) {
+				err := os.Symlink(outside, filepath.Join(versionPath, "out"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: []testEntry{
+				{name: "out/evil", body: "evil", typeflag: tar.TypeReg},
+			},
+			reason: ErrPathTraversal,
+		},
+		{
+			name: "directory through an existing symlink",
+			setup: func(t *testing.T, versionPath string, outside string) {
+				err := os.Symlink(outside, filepath.Join(versionPath, "out"))
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			entries: []testEntry{
+				{name: "out/evil/", typeflag: tar.TypeDir},
+			},
+			reason: ErrPathTraversal,
+		},
+		{
+			name: "absolute symlink",
+			entries: []testEntry{
+				{name: "evil", linkname: "/etc/passwd", typeflag: tar.TypeSymlink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "symlink to the parent directory",
+			entries: []testEntry{
+				{name: "a/evil", linkname: "../../evil", typeflag: tar.TypeSymlink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "file through a symlink in the package",
+			entries: []testEntry{
+				{name: "up", linkname: "..", typeflag: tar.TypeSymlink},
+				{name: "up/evil", body: "evil", typeflag: tar.TypeReg},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "hardlink outside",
+			entries: []testEntry{
+				{name: "evil", linkname: "../evil", typeflag: tar.TypeLink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "absolute hardlink",
+			entries: []testEntry{
+				{name: "evil", linkname: "/etc/passwd", typeflag: tar.TypeLink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "hardlink to a directory",
+			entries: []testEntry{
+				{name: "a/", typeflag: tar.TypeDir},
+				{name: "evil", linkname: "a", typeflag: tar.TypeLink},
+			},
+			reason: ErrUnsafeLink,
+		},
+		{
+			name: "character device",
+			entries: []testEntry{
+				{name: "evil", typeflag: tar.TypeChar},
+			},
+			reason: ErrUnsupportedEntry,
+		},
+		{
+			name: "block device",
+			entries: []testEntry{
+				{name: "evil", typeflag: tar.TypeBlock},
+			},
+			reason: ErrUnsupportedEntry,
+		},
+		{
+			name: "fifo",
+			entries: []testEntry{
+				{name: "evil", typeflag: tar.TypeFifo},
+			},
+			reason: ErrUnsupportedEntry,
+		},
+		{
+			name:   "too many entries",
+			limits: ExtractionLimits{MaxFiles: 2},
+			entries: []testEntry{
+				{name: "a", body: "a", typeflag: tar.TypeReg},
+				{name: "b", body: "b", typeflag: tar.TypeReg},
+				{name: "c", body: "c", typeflag: tar.TypeReg},
+			},
+			reason: ErrLimitExceeded,
+		},
+		{
+			name:   "file too large",
+			limits: ExtractionLimits{MaxFileSize: 4},
+			entries: []testEntry{
+				{name: "a", body: "hello", typeflag: tar.TypeReg},
+			},
+			reason: ErrLimitExceeded,
+		},
+		{
+			name:   "package too large",
+			limits: ExtractionLimits{MaxTotalSize: 8},
+			entries: []testEntry{
+				{name: "a", body: "hello", typeflag: tar.TypeReg},
+				{name: "b", body: "hello", typeflag: tar.TypeReg},
+			},
+			reason: ErrLimitExceeded,
+		},
+		{
+			name:   "highly compressed file",
+			limits: ExtractionLimits{MaxTotalSize: 1 << 16},
+			entries: []testEntry{
+				{name: "zeros", body: zeros, typeflag: tar.TypeReg},
+			},
+			reason: ErrLimitExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updater := newTestUpdater(t, Target{ExtractionLimits: test.limits})
+			outside := t.TempDir()
+			if test.setup != nil {
+				versionPath := filepath.Join(updater.target.VersionsPath, "1.0.0.0")
+				err := os.MkdirAll(versionPath, 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				test.setup(t, versionPath, outside)
+			}
+			_, err := extractTestPackage(t, updater, test.entries)
+			if errors.Is(err, test.reason) == false {
+				t.Fatalf("Expected %s, got %v", test.reason, err)
+			}
+			for _, path := range []string{
+				filepath.Join(updater.target.VersionsPath, "evil"),
+				filepath.Join(outside, "evil"),
+			} {
+				if _, err := os.Lstat(path); err == nil {
+					t.Fatalf("Entry was written outside the version at '%s'", path)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestExtractOwnership(t *testing.T) {
+	entries := []testEntry{
+		{name: "setuid", body: "x", typeflag: tar.TypeReg, mode: 04755, uid: 1234, gid: 1234},
+		{name: "setgid", body: "x", typeflag: tar.TypeReg, mode: 02755, uid: 1234, gid: 1234},
+	}
+
+	tests := []struct {
+		name     string
+		preserve bool
+	}{
+		{name: "default"},
+		{name: "preserved", preserve: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Ownership is only preserved when running as root
+			preserved := test.preserve && os.Geteuid() == 0
+			updater := newTestUpdater(t, Target{PreservePackageOwnership: test.preserve})
+			versionPath, err := extractTestPackage(t, updater, entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, entry := range entries {
+				info, err := os.Lstat(filepath.Join(versionPath, entry.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				special := info.Mode() & (os.ModeSetuid | os.ModeSetgid)
+				if preserved == false && special != 0 {
+					t.Fatalf("Expected '%s' without setuid and setgid, got %s", entry.name, info.Mode())
+				}
+				if preserved && special == 0 {
+					t.Fatalf("Expected '%s' to keep its mode, got %s", entry.name, info.Mode())
+				}
+				uid := int(info.Sys().(*syscall.Stat_t).Uid)
+				if preserved == false && uid != os.Geteuid() {
+					t.Fatalf("Expected '%s' to be owned by %d, got %d", entry.name, os.Geteuid(), uid)
+				}
+				if preserved && uid != entry.uid {
+					t.Fatalf("Expected '%s' to be owned by %d, got %d", entry.name, entry.uid, uid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	// PackageTypeTarGz is a gzip compressed tar archive
+	PackageTypeTarGz = "tar.gz"
+	// PackageTypeTarXz is an xz compressed tar archive
+	PackageTypeTarXz = "tar.xz"
+	// PackageTypeTarZst is a zstd compressed tar archive
+	PackageTypeTarZst = "tar.zst"
+	// PackageTypeZip is a zip archive
+	PackageTypeZip = "zip"
+	// PackageTypeBinary is a single executable that replaces the target's
+	// ApplicationName
+	PackageTypeBinary = "binary"
+
+	// maxZipLinkLength is the maximum length of a symlink target stored in a
+	// zip archive
+	maxZipLinkLength = 4096
+)
+
+// packageExtensions maps the extensions of package names to package types
+var packageExtensions = []struct {
+	extension   string
+	packageType string
+}{
+	{".tar.gz", PackageTypeTarGz},
+	{".tgz", PackageTypeTarGz},
+	{".tar.xz", PackageTypeTarXz},
+	{".txz", PackageTypeTarXz},
+	{".tar.zst", PackageTypeTarZst},
+	{".tzst", PackageTypeTarZst},
+	{".zip", PackageTypeZip},
+	{".exe", PackageTypeBinary},
+}
+
+// Extractor installs a downloaded package into the directory of the new
+// version. The directory already contains a copy of the current version
+type Extractor interface {
+	// Extract the package at packagePath into versionPath. Cancelling the
+	// context aborts the extraction
+	Extract(ctx context.Context, packagePath string, versionPath string) error
+}
+
+// packageType returns the type of the package. An explicit type is used as
+// is, otherwise the type is derived from the extension of the package name.
+// A package named after the binary name is a raw binary. Packages with an
+// unknown extension are gzip compressed tar archives
+func packageType(omahaPackage omaha.Package, binaryName string) string {
+	if omahaPackage.Type != "" {
+		packageType := strings.ToLower(omahaPackage.Type)
+		for _, known := range packageExtensions {
+			if "."+packageType == known.extension {
+				return known.packageType
+			}
+		}
+		return packageType
+	}
+
+	name := strings.ToLower(omahaPackage.Name)
+	if binaryName != "" && name == strings.ToLower(filepath.Base(binaryName)) {
+		return PackageTypeBinary
+	}
+	for _, known := range packageExtensions {
+		if strings.HasSuffix(name, known.extension) {
+			return known.packageType
+		}
+	}
+	return PackageTypeTarGz
+}
+
+// packageExtractor returns the extractor for the type of the package.
+// Extractors set on the target take precedence over the built-in extractors.
+// Raw binaries are installed as binaryName, or as the package name if empty
+func (updater *Unattended) packageExtractor(
+	omahaPackage omaha.Package,
+	binaryName string) (Extractor, error) {
+
+	packageType := packageType(omahaPackage, binaryName)
+	if extractor, ok := updater.target.Extractors[packageType]; ok {
+		return extractor, nil
+	}
+
+	switch packageType {
+	case PackageTypeTarGz:
+		return tarExtractor{updater: updater, decompress: decompressGzip}, nil
+	case PackageTypeTarXz:
+		return tarExtractor{updater: updater, decompress: decompressXz}, nil
+	case PackageTypeTarZst:
+		return tarExtractor{updater: updater, decompress: decompressZstd}, nil
+	case PackageTypeZip:
+		return zipExtractor{updater: updater}, nil
+	case PackageTypeBinary:
+		if binaryName == "" {
+			binaryName = omahaPackage.Name
+		}
+		return binaryExtractor{updater: updater, name: binaryName}, nil
+	}
+	return nil, fmt.Errorf("Unsupported package type '%s'", packageType)
+}
+
+// newSafeExtractor creates the safe extractor for the version directory
+// with the extraction settings of the target
+func (updater *Unattended) newSafeExtractor(versionPath string) (*safeExtractor, error) {
+	return newSafeExtractor(
+		versionPath,
+		updater.target.ExtractionLimits,
+		updater.target.IgnorePackagePermissions,
+		updater.target.PreservePackageOwnership,
+		updater.log)
+}
+
+// tarExtractor extracts compressed tar archives
+type tarExtractor struct {
+	updater    *Unattended
+	decompress func(reader io.Reader) (io.ReadCloser, error)
+}
+
+// Extract the tar archive into the version directory
+func (extractor tarExtractor) Extract(
+	ctx context.Context,
+	packagePath string,
+	versionPath string) error {
+
+	safeExtractor, err := extractor.updater.newSafeExtractor(versionPath)
+	if err != nil {
+		return err
+	}
+
+	downloadedPackage, err := os.Open(packagePath)
+	if err != nil {
+		return err
+	}
+	defer downloadedPackage.Close()
+	decompressed, err := extractor.decompress(downloadedPackage)
+	if err != nil {
+		return fmt.Errorf("Unable to read package: %s", err)
+	}
+	defer decompressed.Close()
+
+	tarReader := tar.NewReader(decompressed)
+	// Go through all files in tar archive
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		header, err := tarReader.Next()
+
+		// No more
+		if err == io.EOF {
+			return safeExtractor.finish()
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read package: %s", err)
+		}
+
+		err = safeExtractor.extractTarEntry(header, tarReader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decompressGzip returns a reader for gzip compressed content
+func decompressGzip(reader io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(reader)
+}
+
+// decompressXz returns a reader for xz compressed content
+func decompressXz(reader io.Reader) (io.ReadCloser, error) {
+	xzReader, err := xz.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(xzReader), nil
+}
+
+// decompressZstd returns a reader for zstd compressed content
+func decompressZstd(reader io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// zipExtractor extracts zip archives. Entries are converted to tar headers
+// to apply the same extraction policy
+type zipExtractor struct {
+	updater *Unattended
+}
+
+// Extract the zip archive into the version directory
+func (extractor zipExtractor) Extract(
+	ctx context.Context,
+	packagePath string,
+	versionPath string) error {
+
+	safeExtractor, err := extractor.updater.newSafeExtractor(versionPath)
+	if err != nil {
+		return err
+	}
+
+	zipReader, err := zip.OpenReader(packagePath)
+	if err != nil {
+		return fmt.Errorf("Unable to read package: %s", err)
+	}
+	defer zipReader.Close()
+
+	for _, file := range zipReader.File {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := extractor.extractFile(safeExtractor, file)
+		if err != nil {
+			return err
+		}
+	}
+	return safeExtractor.finish()
+}
+
+// extractFile extracts a single entry of the zip archive
+func (extractor zipExtractor) extractFile(safeExtractor *safeExtractor, file *zip.File) error {
+	content, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("Unable to read package: %s", err)
+	}
+	defer content.Close()
+
+	// Zip archives store the target of a symlink as its content
+	var linkname string
+	if file.Mode()&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(content, maxZipLinkLength))
+		if err != nil {
+			return fmt.Errorf("Unable to read package: %s", err)
+		}
+		linkname = string(target)
+	}
+
+	header, err := tar.FileInfoHeader(file.FileInfo(), linkname)
+	if err != nil {
+		return &ExtractionError{
+			Entry:  file.Name,
+			Reason: ErrUnsupportedEntry,
+			Detail: err.Error(),
+		}
+	}
+	header.Name = file.Name
+	header.ModTime = file.Modified
+	header.Uid = os.Getuid()
+	header.Gid = os.Getgid()
+	if zipHasUnixModes(file) == false {
+		// Archives created on other platforms have no permissions, don't
+		// make everything writable for everyone
+		header.Mode = 0644
+		if header.Typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+	}
+	return safeExtractor.extractTarEntry(header, content)
+}
+
+// zipHasUnixModes returns true if the entry was added on a platform that
+// stores Unix permissions
+func zipHasUnixModes(file *zip.File) bool {
+	const (
+		creatorUnix   = 3
+		creatorMacOSX = 19
+	)
+	creator := file.CreatorVersion >> 8
+	return creator == creatorUnix || creator == creatorMacOSX
+}
+
+// binaryExtractor installs a package that is a single executable under the
+// given name, the target's ApplicationName for packages of the target
+type binaryExtractor struct {
+	updater *Unattended
+	name    string
+}
+
+// Extract replaces the executable in the version directory with the package
+func (extractor binaryExtractor) Extract(
+	ctx context.Context,
+	packagePath string,
+	versionPath string) error {
+
+	safeExtractor, err := extractor.updater.newSafeExtractor(versionPath)
+	if err != nil {
+		return err
+	}
+
+	downloadedPackage, err := os.Open(packagePath)
+	if err != nil {
+		return err
+	}
+	defer downloadedPackage.Close()
+	info, err := downloadedPackage.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(extractor.name),
+		Mode:     0755,
+		Size:     info.Size(),
+		ModTime:  time.Now(),
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+	}
+	err = safeExtractor.extractTarEntry(header, downloadedPackage)
+	if err != nil {
+		return err
+	}
+	return safeExtractor.finish()
+}
@@ -0,0 +1,301 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultHealthCheckInterval is the health check interval used if none
+	// is set on the target
+	DefaultHealthCheckInterval = time.Second * 10
+	// DefaultHealthCheckTimeout is the health check timeout used if none is
+	// set on the target
+	DefaultHealthCheckTimeout = time.Second * 5
+	// DefaultHealthCheckThreshold is the number of consecutive failed health
+	// checks used if none is set on the target
+	DefaultHealthCheckThreshold = 3
+)
+
+// ErrHealthPending is returned by a HealthCheck while the health of the
+// target can't be determined yet. It counts as neither success nor failure
+var ErrHealthPending = errors.New("Health is not known yet")
+
+// HealthCheck checks if the running target is healthy
+type HealthCheck interface {
+	// Check returns nil if the target is healthy. The context is cancelled
+	// once the health check timeout expires
+	Check(ctx context.Context, process TargetProcess) error
+}
+
+// TargetProcess describes a running target process
+type TargetProcess struct {
+	// PID of the target process
+	PID int
+	// Version of the target that is running
+	Version string
+	// Started is the time the target process was started
+	Started time.Time
+	// Running is false once the target process has completed
+	Running bool
+}
+
+// HealthStatus is the health of the target
+type HealthStatus int
+
+const (
+	// HealthUnknown is the status before the first health check completed
+	HealthUnknown HealthStatus = iota
+	// HealthHealthy is the status once a health check succeeded
+	HealthHealthy
+	// HealthUnhealthy is the status once the failure threshold is reached
+	HealthUnhealthy
+)
+
+// String returns the name of the status
+func (status HealthStatus) String() string {
+	switch status {
+	case HealthHealthy:
+		return "healthy"
+	case HealthUnhealthy:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+// Health contains the health state of the target
+type Health struct {
+	// Status of the target
+	Status HealthStatus
+	// Version of the target the health applies to
+	Version string
+	// Running is true while the target process is running
+	Running bool
+	// ConsecutiveFailures is the number of failed checks since the last
+	// successful check
+	ConsecutiveFailures int
+	// LastError of the last failed check
+	LastError error
+	// LastCheck is the time of the last completed check
+	LastCheck time.Time
+}
+
+// HTTPHealthCheck is healthy when a GET request to URL returns a status code
+// between MinStatusCode and MaxStatusCode
+type HTTPHealthCheck struct {
+	// URL to request
+	URL string
+	// MinStatusCode accepted as healthy, defaults to 200
+	MinStatusCode int
+	// MaxStatusCode accepted as healthy, defaults to 399
+	MaxStatusCode int
+}
+
+// Check the target by requesting the URL
+func (check HTTPHealthCheck) Check(ctx context.Context, process TargetProcess) error {
+	minStatusCode := check.MinStatusCode
+	if minStatusCode == 0 {
+		minStatusCode = http.StatusOK
+	}
+	maxStatusCode := check.MaxStatusCode
+	if maxStatusCode == 0 {
+		maxStatusCode = 399
+	}
+
+	request, err := http.NewRequest(http.MethodGet, check.URL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < minStatusCode || response.StatusCode > maxStatusCode {
+		return fmt.Errorf("Received HTTP status code %d", response.StatusCode)
+	}
+	return nil
+}
+
+// TCPHealthCheck is healthy when a TCP connection to Address can be opened
+type TCPHealthCheck struct {
+	// Address to connect to in the form host:port
+	Address string
+}
+
+// Check the target by connecting to the address
+func (check TCPHealthCheck) Check(ctx context.Context, process TargetProcess) error {
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "tcp", check.Address)
+	if err != nil {
+		return err
+	}
+	return connection.Close()
+}
+
+// CommandHealthCheck is healthy when the command exits with status 0
+type CommandHealthCheck struct {
+	// Command to execute
+	Command string
+	// Arguments to execute the command with
+	Arguments []string
+}
+
+// Check the target by executing the command
+func (check CommandHealthCheck) Check(ctx context.Context, process TargetProcess) error {
+	output, err := exec.CommandContext(ctx, check.Command, check.Arguments...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+	return nil
+}
+
+// ProcessHealthCheck is healthy when the target process is still running
+// after MinUptime
+type ProcessHealthCheck struct {
+	// MinUptime the process must be running for
+	MinUptime time.Duration
+}
+
+// Check the target process is running
+func (check ProcessHealthCheck) Check(ctx context.Context, process TargetProcess) error {
+	if process.Running == false {
+		return fmt.Errorf("Process %d is not running", process.PID)
+	}
+	if time.Since(process.Started) < check.MinUptime {
+		return ErrHealthPending
+	}
+	return nil
+}
+
+// Health returns the health state of the target
+func (updater *Unattended) Health() Health {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	return updater.health
+}
+
+// healthMonitor reports the results of the health checks of a single run of
+// the target
+type healthMonitor struct {
+	// healthy is closed once a health check succeeded
+	healthy chan struct{}
+	// unhealthy receives the last error once the failure threshold is reached
+	unhealthy chan error
+}
+
+// monitorHealth runs the health checks of the target until it has completed
+func (updater *Unattended) monitorHealth(
+	process TargetProcess,
+	exited chan struct{}) *healthMonitor {
+
+	monitor := &healthMonitor{
+		healthy:   make(chan struct{}),
+		unhealthy: make(chan error, 1),
+	}
+	version := process.Version
+
+	updater.mutex.Lock()
+	updater.health = Health{Version: version, Running: true}
+	if updater.target.HealthCheck == nil {
+		// Without a health check the target is healthy once started
+		updater.health.Status = HealthHealthy
+		close(monitor.healthy)
+	}
+	updater.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			updater.mutex.Lock()
+			updater.health.Running = false
+			updater.mutex.Unlock()
+		}()
+		if updater.target.HealthCheck == nil {
+			<-exited
+			return
+		}
+
+		ticker := time.NewTicker(updater.target.HealthCheckInterval)
+		defer ticker.Stop()
+		healthy := false
+		for {
+			select {
+			case <-exited:
+				return
+			case <-ticker.C:
+			}
+
+			// The check is given the live state of the process, it may have
+			// completed since the last check
+			updater.mutex.Lock()
+			process.Running = updater.exited == exited && updater.process.Running
+			updater.mutex.Unlock()
+
+			ctx, cancel := context.WithTimeout(
+				context.Background(),
+				updater.target.HealthCheckTimeout)
+			err := updater.target.HealthCheck.Check(ctx, process)
+			cancel()
+			if err == ErrHealthPending {
+				continue
+			}
+
+			updater.mutex.Lock()
+			updater.health.LastCheck = time.Now()
+			if err == nil {
+				updater.health.Status = HealthHealthy
+				updater.health.ConsecutiveFailures = 0
+				updater.health.LastError = nil
+			} else {
+				updater.health.ConsecutiveFailures++
+				updater.health.LastError = err
+				if updater.health.ConsecutiveFailures >= updater.target.HealthCheckThreshold {
+					updater.health.Status = HealthUnhealthy
+				}
+			}
+			health := updater.health
+			updater.mutex.Unlock()
+
+			if err == nil && healthy == false {
+				healthy = true
+				close(monitor.healthy)
+			}
+			if err != nil {
+				updater.log.WithFields(logrus.Fields{
+					"version":  version,
+					"failures": health.ConsecutiveFailures,
+				}).Warningf("Health check failed: %s", err)
+			}
+			if health.Status == HealthUnhealthy {
+				monitor.unhealthy <- fmt.Errorf(
+					"Target failed %d health checks: %s",
+					health.ConsecutiveFailures,
+					err)
+				return
+			}
+		}
+	}()
+
+	return monitor
+}
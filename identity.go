@@ -0,0 +1,79 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+const (
+	// clientIDFileName is the state file holding the generated client ID
+	clientIDFileName = "client_id"
+)
+
+// installClientID returns the client ID generated for the installation. The
+// ID is generated once and persisted in VersionsPath to stay stable across
+// restarts
+func installClientID(target *Target) (string, error) {
+	path := target.statePath(clientIDFileName)
+	content, err := ioutil.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	clientID, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(path, []byte(clientID+"\n"))
+	if err != nil {
+		return "", err
+	}
+	target.logger().WithField(
+		"client_id", clientID,
+	).Info("Generated client ID")
+	return clientID, nil
+}
+
+// identify sets the identity and platform of the client on the request
+// where not set
+func (updater *Unattended) identify(omahaRequest *omaha.Request) {
+	if omahaRequest.UserID == "" {
+		omahaRequest.UserID = updater.clientID
+	}
+	if omahaRequest.SessionID == "" {
+		omahaRequest.SessionID = updater.sessionID
+	}
+	if omahaRequest.InstallSource == "" {
+		omahaRequest.InstallSource = updater.target.InstallSource
+	}
+	if omahaRequest.OS == nil {
+		omahaRequest.OS = updater.platform
+	}
+	if omahaRequest.HW == nil {
+		omahaRequest.HW = updater.hw
+	}
+	for i := range omahaRequest.Applications {
+		omahaApp := &omahaRequest.Applications[i]
+		if omahaApp.ClientID == "" {
+			omahaApp.ClientID = updater.clientID
+		}
+		if omahaApp.Attributes == nil {
+			omahaApp.Attributes = updater.appAttributes(omahaApp.ID)
+		}
+	}
+}
@@ -30,8 +30,14 @@ type App struct {
 	ClientID string `xml:"bootid,attr"`
 	/// Event being sent to the server
 	Event Event `xml:"event"`
-	/// Response for update events.
-	UpdateCheck UpdateCheck `xml:"updatecheck,omitempty"`
+	/// Ping reporting the application as installed and active
+	Ping *Ping `xml:"ping,omitempty"`
+	/// UpdateCheck requests an update, or is the response to it. Requests
+	/// reporting events have none
+	UpdateCheck *UpdateCheck `xml:"updatecheck,omitempty"`
 	/// Reason for failure if status is not Ok
-	Reason string `xml:"reason"`
+	Reason string `xml:"reason,omitempty"`
+	/// Attributes are custom attributes of the application, for example the
+	/// hardware model
+	Attributes []xml.Attr `xml:",any,attr"`
 }
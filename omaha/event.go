@@ -56,4 +56,14 @@ type Event struct {
 	Type string `xml:"eventtype,attr"`
 	// Result of event
 	Result string `xml:"eventresult,attr"`
+	// ErrorCode of a failed operation
+	ErrorCode int `xml:"errorcode,attr,omitempty"`
+	// PreviousVersion of the application before the operation
+	PreviousVersion string `xml:"previousversion,attr,omitempty"`
+	// NextVersion of the application the operation is updating to
+	NextVersion string `xml:"nextversion,attr,omitempty"`
+	// Downloaded is the number of bytes downloaded by a download event
+	Downloaded uint64 `xml:"downloaded,attr,omitempty"`
+	// Total is the number of bytes expected by a download event
+	Total uint64 `xml:"total,attr,omitempty"`
 }
@@ -0,0 +1,41 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package omaha
+
+import "encoding/xml"
+
+// HW describes the hardware of the client. Processor features are set to 1
+// if supported
+type HW struct {
+	XMLName xml.Name `xml:"hw"`
+	// PhysMemory is the physical memory rounded to GB
+	PhysMemory uint64 `xml:"physmemory,attr,omitempty"`
+	// SSE support of the processor
+	SSE int `xml:"sse,attr,omitempty"`
+	// SSE2 support of the processor
+	SSE2 int `xml:"sse2,attr,omitempty"`
+	// SSE3 support of the processor
+	SSE3 int `xml:"sse3,attr,omitempty"`
+	// SSSE3 support of the processor
+	SSSE3 int `xml:"ssse3,attr,omitempty"`
+	// SSE41 is SSE4.1 support of the processor
+	SSE41 int `xml:"sse41,attr,omitempty"`
+	// SSE42 is SSE4.2 support of the processor
+	SSE42 int `xml:"sse42,attr,omitempty"`
+	// AVX support of the processor
+	AVX int `xml:"avx,attr,omitempty"`
+	// Features of processors without the x86 attributes, for example arm64,
+	// separated by spaces
+	Features string `xml:"features,attr,omitempty"`
+}
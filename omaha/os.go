@@ -0,0 +1,29 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package omaha
+
+import "encoding/xml"
+
+// OS describes the operating system of the client
+type OS struct {
+	XMLName xml.Name `xml:"os"`
+	// Platform of the operating system, for example 'linux' or 'windows'
+	Platform string `xml:"platform,attr"`
+	// Version of the operating system or kernel
+	Version string `xml:"version,attr,omitempty"`
+	// Arch is the processor architecture, for example 'amd64' or 'arm64'
+	Arch string `xml:"arch,attr,omitempty"`
+	// ServicePack of the operating system
+	ServicePack string `xml:"sp,attr,omitempty"`
+}
@@ -24,4 +24,10 @@ type Package struct {
 	Name string `xml:"name,attr,omitempty"`
 	// SizeInBytes of the download package
 	SizeInBytes uint64 `xml:"size,attr,omitempty"`
+	// Type of the download package, for example 'tar.gz', 'zip' or
+	// 'binary'. If not set the type is derived from Name
+	Type string `xml:"type,attr,omitempty"`
+	// Signature is the base64 encoded Ed25519 signature of the SHA-256
+	// digest of the download package
+	Signature string `xml:"signature,attr,omitempty"`
 }
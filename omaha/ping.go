@@ -0,0 +1,30 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package omaha
+
+import "encoding/xml"
+
+// Ping reports the application as installed and, if set, active. Pings are
+// sent at most once per day
+type Ping struct {
+	XMLName xml.Name `xml:"ping"`
+	// Active is 1 if the application was active since the last active ping
+	Active int `xml:"active,attr,omitempty"`
+	// DaysSinceActive is the number of days since the last active ping, -1
+	// if the application was never reported active
+	DaysSinceActive int `xml:"a,attr,omitempty"`
+	// DaysSinceRollCall is the number of days since the last ping, -1 for
+	// the first ping
+	DaysSinceRollCall int `xml:"r,attr,omitempty"`
+}
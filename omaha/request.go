@@ -20,6 +20,20 @@ type Request struct {
 	XMLName xml.Name `xml:"request"`
 	// Protocol version of the request
 	Protocol float32 `xml:"protocol,attr"`
-	// Application information for the request
-	Application App `xml:"app"`
+	// RequestID is a unique ID for the request, echoed by the server in
+	// the response
+	RequestID string `xml:"requestid,attr,omitempty"`
+	// UserID is the stable ID of the installation
+	UserID string `xml:"userid,attr,omitempty"`
+	// SessionID is a unique ID shared by the requests of a session
+	SessionID string `xml:"sessionid,attr,omitempty"`
+	// InstallSource is the cause of the request, for example 'scheduler' or
+	// 'ondemand'
+	InstallSource string `xml:"installsource,attr,omitempty"`
+	// OS of the client
+	OS *OS `xml:"os,omitempty"`
+	// HW is the hardware of the client
+	HW *HW `xml:"hw,omitempty"`
+	// Applications checked or reported on in the request
+	Applications []App `xml:"app"`
 }
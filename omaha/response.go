@@ -20,6 +20,11 @@ type Response struct {
 	XMLName xml.Name `xml:"response"`
 	// Protocol version fo the response
 	Protocol float32 `xml:"protocol,attr"`
-	// Application being responded on
-	Application App `xml:"app"`
+	// RequestID of the request being responded to
+	RequestID string `xml:"requestid,attr,omitempty"`
+	// Expires is the time in RFC 3339 format after which the response must
+	// no longer be accepted
+	Expires string `xml:"expires,attr,omitempty"`
+	// Applications being responded on
+	Applications []App `xml:"app"`
 }
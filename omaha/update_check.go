@@ -20,6 +20,10 @@ type UpdateCheck struct {
 	XML xml.Name `xml:"updatecheck,omitempty"`
 	// Status of the update check
 	Status string `xml:"status,attr,omitempty"`
+	// Rollback allows the manifest to install a version older than the
+	// installed version. The installed versions newer than the manifest are
+	// marked as bad
+	Rollback bool `xml:"rollback,attr,omitempty"`
 	// Manifest of the update package
 	Manifest Manifest `xml:"manifest"`
 }
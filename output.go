@@ -0,0 +1,129 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// StreamStdout is the name of the target's standard output stream
+	StreamStdout = "stdout"
+	// StreamStderr is the name of the target's standard error stream
+	StreamStderr = "stderr"
+	// maxLineLength is the length after which long lines are split
+	maxLineLength = 64 * 1024
+	// outputDrainTimeout is the time the output of a completed target is
+	// forwarded for. Processes that escaped the process group may keep the
+	// output open and keep writing to it
+	outputDrainTimeout = time.Second * 5
+)
+
+// OutputOptions defines how the lines of the target's output are formatted
+type OutputOptions struct {
+	// Timestamps prefixes lines with the time they were read
+	Timestamps bool
+	// TimestampFormat is the format of the timestamps, defaults to
+	// time.RFC3339
+	TimestampFormat string
+	// ShowVersion prefixes lines with the version of the target
+	ShowVersion bool
+	// ShowPID prefixes lines with the PID of the target
+	ShowPID bool
+	// ShowStream prefixes lines with the name of the stream
+	ShowStream bool
+}
+
+// forwardOutput reads the stream of the target line by line and forwards
+// each line until the stream is closed
+func (updater *Unattended) forwardOutput(
+	process TargetProcess,
+	stream string,
+	reader io.Reader) {
+
+	bufferedReader := bufio.NewReaderSize(reader, maxLineLength)
+	for {
+		line, err := bufferedReader.ReadSlice('\n')
+		if len(line) > 0 {
+			updater.writeOutputLine(process, stream, bytes.TrimRight(line, "\r\n"))
+		}
+		if err == bufio.ErrBufferFull {
+			// Long lines are forwarded in parts
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeOutputLine writes a single line of output to the writer of the
+// stream. Lines are written whole so streams sharing a writer don't mix
+func (updater *Unattended) writeOutputLine(
+	process TargetProcess,
+	stream string,
+	line []byte) {
+
+	updater.mutex.Lock()
+	options := updater.outputOptions
+	writer := updater.stdoutWriter
+	if stream == StreamStderr {
+		writer = updater.stderrWriter
+	}
+	log := updater.outputLogger
+	parsers := updater.outputParsers
+	updater.mutex.Unlock()
+
+	if log != nil {
+		updater.logOutputLine(log, parsers, process, stream, line)
+		return
+	}
+	if writer == nil {
+		return
+	}
+
+	var formatted bytes.Buffer
+	if options.Timestamps {
+		format := options.TimestampFormat
+		if format == "" {
+			format = time.RFC3339
+		}
+		formatted.WriteString(time.Now().Format(format))
+		formatted.WriteString(" ")
+	}
+	var prefixes []string
+	if options.ShowVersion {
+		prefixes = append(prefixes, process.Version)
+	}
+	if options.ShowPID {
+		prefixes = append(prefixes, fmt.Sprintf("%d", process.PID))
+	}
+	if options.ShowStream {
+		prefixes = append(prefixes, stream)
+	}
+	if len(prefixes) > 0 {
+		formatted.WriteString("[" + strings.Join(prefixes, " ") + "] ")
+	}
+	formatted.Write(line)
+	formatted.WriteString("\n")
+
+	updater.outputMutex.Lock()
+	defer updater.outputMutex.Unlock()
+	writer.Write(formatted.Bytes())
+}
@@ -0,0 +1,258 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LineParser parses structured lines of the target's output
+type LineParser interface {
+	// Parse returns the parsed line and true if the line is in the format
+	// of the parser
+	Parse(line []byte) (ParsedLine, bool)
+}
+
+// ParsedLine is a line of output parsed by a LineParser
+type ParsedLine struct {
+	// Level of the line as written by the target, for example 'info' or
+	// 'warn'. Empty if the line has no level
+	Level string
+	// Message of the line
+	Message string
+	// Fields of the line other than the level and message
+	Fields logrus.Fields
+}
+
+// SetOutputLogger logs each line of the target's output to the log entry
+// instead of writing it to the output writers. Entries have the fields
+// stream, version, pid and app_id. Lines from standard output are logged at
+// info level and lines from standard error at warning level, unless one of
+// the parsers finds the level in the line. Parsers are tried in order
+func (updater *Unattended) SetOutputLogger(log *logrus.Entry, parsers ...LineParser) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	updater.outputLogger = log
+	updater.outputParsers = parsers
+}
+
+// logOutputLine logs a single line of output as a log entry
+func (updater *Unattended) logOutputLine(
+	log *logrus.Entry,
+	parsers []LineParser,
+	process TargetProcess,
+	stream string,
+	line []byte) {
+
+	level := logrus.InfoLevel
+	if stream == StreamStderr {
+		level = logrus.WarnLevel
+	}
+	parsed := ParsedLine{Message: string(line)}
+	for _, parser := range parsers {
+		if result, ok := parser.Parse(line); ok {
+			parsed = result
+			break
+		}
+	}
+	if parsed.Level != "" {
+		if parsedLevel, err := logrus.ParseLevel(parsed.Level); err == nil {
+			level = parsedLevel
+		}
+	}
+	// The target's fatal and panic lines must not exit Unattended
+	if level < logrus.ErrorLevel {
+		level = logrus.ErrorLevel
+	}
+
+	log.WithFields(parsed.Fields).WithFields(logrus.Fields{
+		"stream":  stream,
+		"version": process.Version,
+		"pid":     process.PID,
+		"app_id":  updater.target.AppID,
+	}).Log(level, parsed.Message)
+}
+
+// JSONLineParser parses lines that are JSON objects, as written by most
+// structured loggers
+type JSONLineParser struct {
+	// LevelKeys are the keys that can hold the level, defaults to 'level',
+	// 'lvl' and 'severity'
+	LevelKeys []string
+	// MessageKeys are the keys that can hold the message, defaults to 'msg'
+	// and 'message'
+	MessageKeys []string
+	// IgnoredKeys are not added as fields, defaults to 'time', 'ts' and
+	// 'timestamp'
+	IgnoredKeys []string
+}
+
+// Parse the line as a JSON object
+func (parser JSONLineParser) Parse(line []byte) (ParsedLine, bool) {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return ParsedLine{}, false
+	}
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return ParsedLine{}, false
+	}
+
+	stringValues := make(map[string]string)
+	for key, value := range values {
+		stringValues[key] = fmt.Sprint(value)
+	}
+	return parseKeyValues(
+		values,
+		stringValues,
+		defaultKeys(parser.LevelKeys, "level", "lvl", "severity"),
+		defaultKeys(parser.MessageKeys, "msg", "message"),
+		defaultKeys(parser.IgnoredKeys, "time", "ts", "timestamp")), true
+}
+
+// LogfmtLineParser parses lines in the logfmt format, key=value pairs
+// separated by spaces with optionally quoted values
+type LogfmtLineParser struct {
+	// LevelKeys are the keys that can hold the level, defaults to 'level'
+	// and 'lvl'
+	LevelKeys []string
+	// MessageKeys are the keys that can hold the message, defaults to 'msg'
+	// and 'message'
+	MessageKeys []string
+	// IgnoredKeys are not added as fields, defaults to 'time', 'ts' and
+	// 'timestamp'
+	IgnoredKeys []string
+}
+
+// Parse the line as logfmt. Every part of the line must be a key=value pair
+func (parser LogfmtLineParser) Parse(line []byte) (ParsedLine, bool) {
+	pairs, ok := parseLogfmt(string(line))
+	if ok == false {
+		return ParsedLine{}, false
+	}
+
+	values := make(map[string]interface{})
+	for key, value := range pairs {
+		values[key] = value
+	}
+	return parseKeyValues(
+		values,
+		pairs,
+		defaultKeys(parser.LevelKeys, "level", "lvl"),
+		defaultKeys(parser.MessageKeys, "msg", "message"),
+		defaultKeys(parser.IgnoredKeys, "time", "ts", "timestamp")), true
+}
+
+// parseKeyValues lifts the level and message out of the values and returns
+// the remaining values as fields
+func parseKeyValues(
+	values map[string]interface{},
+	stringValues map[string]string,
+	levelKeys []string,
+	messageKeys []string,
+	ignoredKeys []string) ParsedLine {
+
+	parsed := ParsedLine{Fields: logrus.Fields{}}
+	skip := make(map[string]bool)
+	for _, key := range ignoredKeys {
+		skip[key] = true
+	}
+	for _, key := range levelKeys {
+		if value, ok := stringValues[key]; ok && parsed.Level == "" {
+			parsed.Level = strings.ToLower(value)
+			skip[key] = true
+		}
+	}
+	for _, key := range messageKeys {
+		if value, ok := stringValues[key]; ok && parsed.Message == "" {
+			parsed.Message = value
+			skip[key] = true
+		}
+	}
+	for key, value := range values {
+		if skip[key] == false {
+			parsed.Fields[key] = value
+		}
+	}
+	return parsed
+}
+
+// parseLogfmt parses the key=value pairs of a logfmt line
+func parseLogfmt(line string) (map[string]string, bool) {
+	pairs := make(map[string]string)
+	remaining := strings.TrimSpace(line)
+	for remaining != "" {
+		separator := strings.IndexAny(remaining, "= ")
+		if separator <= 0 || remaining[separator] != '=' {
+			return nil, false
+		}
+		key := remaining[:separator]
+		remaining = remaining[separator+1:]
+
+		var value string
+		if strings.HasPrefix(remaining, "\"") {
+			end := 1
+			for end < len(remaining) && remaining[end] != '"' {
+				if remaining[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(remaining) {
+				return nil, false
+			}
+			var err error
+			value, err = unquoteLogfmt(remaining[:end+1])
+			if err != nil {
+				return nil, false
+			}
+			remaining = remaining[end+1:]
+			if remaining != "" && remaining[0] != ' ' {
+				return nil, false
+			}
+		} else {
+			end := strings.IndexByte(remaining, ' ')
+			if end == -1 {
+				end = len(remaining)
+			}
+			value = remaining[:end]
+			remaining = remaining[end:]
+		}
+		pairs[key] = value
+		remaining = strings.TrimLeft(remaining, " ")
+	}
+	return pairs, len(pairs) > 0
+}
+
+// unquoteLogfmt removes the quotes and escapes of a quoted logfmt value
+func unquoteLogfmt(quoted string) (string, error) {
+	var value string
+	err := json.Unmarshal([]byte(quoted), &value)
+	return value, err
+}
+
+// defaultKeys returns keys, or the defaults if keys is empty
+func defaultKeys(keys []string, defaults ...string) []string {
+	if len(keys) == 0 {
+		return defaults
+	}
+	return keys
+}
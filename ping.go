@@ -0,0 +1,200 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+const (
+	// pingsFileName is the state file holding the dates of the last pings
+	pingsFileName = "pings.json"
+	// activeFileName is the state file the target touches to mark itself
+	// active
+	activeFileName = "active"
+)
+
+// ActiveFileEnv is the environment variable holding the path of the file the
+// target touches to mark itself active. Setting its modification time has the
+// same effect as calling MarkActive
+const ActiveFileEnv = "UNATTENDED_ACTIVE_FILE"
+
+// pingDates are the dates of the last pings of an application
+type pingDates struct {
+	// RollCall is the time of the last ping
+	RollCall time.Time `json:"roll_call"`
+	// Active is the time of the last ping reporting the application active
+	Active time.Time `json:"active"`
+}
+
+// pingState is the persisted state of the pings
+type pingState struct {
+	// MarkedActive is the last time the target marked itself active
+	MarkedActive time.Time `json:"marked_active"`
+	// Applications are the dates of the last pings by AppID
+	Applications map[string]pingDates `json:"applications"`
+}
+
+// MarkActive marks the target as actively used. The next daily ping reports
+// the target and its components as active
+func (updater *Unattended) MarkActive() {
+	updater.pingMutex.Lock()
+	defer updater.pingMutex.Unlock()
+
+	state := updater.pingState()
+	if state.pendingActive() {
+		return
+	}
+	state.MarkedActive = time.Now().UTC()
+	err := updater.savePingState(state)
+	if err != nil {
+		updater.log.Warningf("Unable to mark target active: %s", err)
+	}
+}
+
+// MarkTargetActive marks the running target as actively used. It is called by
+// a target written in Go, other targets touch the file in ActiveFileEnv
+func MarkTargetActive() error {
+	path := os.Getenv(ActiveFileEnv)
+	if path == "" {
+		return fmt.Errorf("Not started by Unattended, %s is not set", ActiveFileEnv)
+	}
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(path, nil, 0644)
+	}
+	return err
+}
+
+// markedActive returns the last time the target marked itself active, by
+// MarkActive or by touching the active file
+func (updater *Unattended) markedActive(state pingState) time.Time {
+	markedActive := state.MarkedActive
+	info, err := os.Stat(updater.target.statePath(activeFileName))
+	if err == nil && info.ModTime().After(markedActive) {
+		markedActive = info.ModTime().UTC()
+	}
+	return markedActive
+}
+
+// pendingActive returns true if the last mark is not yet reported by all
+// applications pinged before
+func (state pingState) pendingActive() bool {
+	if state.MarkedActive.IsZero() {
+		return false
+	}
+	for _, dates := range state.Applications {
+		if state.MarkedActive.After(dates.Active) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// ping returns the ping for the application, nil if it was already pinged
+// today
+func (updater *Unattended) ping(appID string, now time.Time) *omaha.Ping {
+	updater.pingMutex.Lock()
+	defer updater.pingMutex.Unlock()
+
+	state := updater.pingState()
+	dates := state.Applications[appID]
+	ping := omaha.Ping{
+		DaysSinceRollCall: daysSince(dates.RollCall, now),
+	}
+	if ping.DaysSinceRollCall == 0 {
+		return nil
+	}
+	if updater.markedActive(state).After(dates.Active) {
+		ping.Active = 1
+		ping.DaysSinceActive = daysSince(dates.Active, now)
+	}
+	return &ping
+}
+
+// recordPings persists the dates of the pings delivered in the request
+func (updater *Unattended) recordPings(omahaRequest omaha.Request, now time.Time) {
+	updater.pingMutex.Lock()
+	defer updater.pingMutex.Unlock()
+
+	state := updater.pingState()
+	for _, omahaApp := range omahaRequest.Applications {
+		if omahaApp.Ping == nil {
+			continue
+		}
+		dates := state.Applications[omahaApp.ID]
+		dates.RollCall = now.UTC()
+		if omahaApp.Ping.Active == 1 {
+			dates.Active = now.UTC()
+		}
+		state.Applications[omahaApp.ID] = dates
+	}
+	err := updater.savePingState(state)
+	if err != nil {
+		updater.log.Warningf("Unable to save ping dates: %s", err)
+	}
+}
+
+// pingState reads the persisted state of the pings
+func (updater *Unattended) pingState() pingState {
+	state := pingState{
+		Applications: make(map[string]pingDates),
+	}
+	content, err := ioutil.ReadFile(updater.target.statePath(pingsFileName))
+	if err != nil {
+		return state
+	}
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		updater.log.Warningf("Unable to read ping dates: %s", err)
+	}
+	if state.Applications == nil {
+		state.Applications = make(map[string]pingDates)
+	}
+	return state
+}
+
+// savePingState writes the state of the pings to disk
+func (updater *Unattended) savePingState(state pingState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(updater.target.statePath(pingsFileName), content)
+}
+
+// daysSince returns the number of calendar days in UTC from the time to now,
+// -1 if the time is not set
+func daysSince(last time.Time, now time.Time) int {
+	if last.IsZero() {
+		return -1
+	}
+	lastYear, lastMonth, lastDay := last.UTC().Date()
+	nowYear, nowMonth, nowDay := now.UTC().Date()
+	lastDate := time.Date(lastYear, lastMonth, lastDay, 0, 0, 0, 0, time.UTC)
+	nowDate := time.Date(nowYear, nowMonth, nowDay, 0, 0, 0, 0, time.UTC)
+	days := int(nowDate.Sub(lastDate).Hours() / 24)
+	if days < 0 {
+		// The clock was set back, report as pinged today
+		return 0
+	}
+	return days
+}
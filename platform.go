@@ -0,0 +1,47 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"runtime"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+const (
+	// bytesPerGB is used to report the physical memory in GB
+	bytesPerGB = 1 << 30
+)
+
+// platformOS returns the operating system of the client
+func platformOS() *omaha.OS {
+	version, servicePack := osVersion()
+	return &omaha.OS{
+		Platform:    runtime.GOOS,
+		Version:     version,
+		Arch:        runtime.GOARCH,
+		ServicePack: servicePack,
+	}
+}
+
+// platformHW returns the hardware of the client
+func platformHW() *omaha.HW {
+	hw := hardware()
+	return &hw
+}
+
+// memoryGB rounds the memory in bytes to GB
+func memoryGB(memory uint64) uint64 {
+	return (memory + bytesPerGB/2) / bytesPerGB
+}
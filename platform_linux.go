@@ -0,0 +1,90 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+// osVersion returns the release of the kernel
+func osVersion() (string, string) {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", ""
+	}
+	return strings.TrimSpace(string(release)), ""
+}
+
+// hardware returns the physical memory from /proc/meminfo and the processor
+// features from /proc/cpuinfo. x86 processors list them as flags, arm64
+// processors as Features
+func hardware() omaha.HW {
+	var hw omaha.HW
+	memory, ok := procField("/proc/meminfo", "MemTotal")
+	if ok {
+		// MemTotal is in kB
+		kilobytes, err := strconv.ParseUint(strings.TrimSuffix(memory, " kB"), 10, 64)
+		if err == nil {
+			hw.PhysMemory = memoryGB(kilobytes * 1024)
+		}
+	}
+
+	flags, ok := procField("/proc/cpuinfo", "flags")
+	if ok == false {
+		armFeatures, ok := procField("/proc/cpuinfo", "Features")
+		if ok {
+			hw.Features = strings.Join(strings.Fields(armFeatures), " ")
+		}
+		return hw
+	}
+	features := make(map[string]int)
+	for _, flag := range strings.Fields(flags) {
+		features[flag] = 1
+	}
+	hw.SSE = features["sse"]
+	hw.SSE2 = features["sse2"]
+	// SSE3 is listed as Prescott New Instructions
+	hw.SSE3 = features["pni"]
+	hw.SSSE3 = features["ssse3"]
+	hw.SSE41 = features["sse4_1"]
+	hw.SSE42 = features["sse4_2"]
+	hw.AVX = features["avx"]
+	return hw
+}
+
+// procField returns the value of the first field with the name in the
+// 'name : value' formatted file
+func procField(path string, name string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == name {
+			return strings.TrimSpace(parts[1]), true
+		}
+	}
+	return "", false
+}
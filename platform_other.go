@@ -0,0 +1,30 @@
+//go:build !linux && !windows && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!windows,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import "github.com/ProjectLimitless/go-unattended/omaha"
+
+// osVersion returns no version, it is not available on this platform
+func osVersion() (string, string) {
+	return "", ""
+}
+
+// hardware returns no hardware details, they are not available on this
+// platform
+func hardware() omaha.HW {
+	return omaha.HW{}
+}
@@ -0,0 +1,62 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+var procGlobalMemoryStatusEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// memoryStatusEx is the MEMORYSTATUSEX structure
+type memoryStatusEx struct {
+	length               uint32
+	memoryLoad           uint32
+	totalPhys            uint64
+	availPhys            uint64
+	totalPageFile        uint64
+	availPageFile        uint64
+	totalVirtual         uint64
+	availVirtual         uint64
+	availExtendedVirtual uint64
+}
+
+// osVersion returns the version of Windows
+func osVersion() (string, string) {
+	version, err := syscall.GetVersion()
+	if err != nil {
+		return "", ""
+	}
+	return fmt.Sprintf(
+		"%d.%d.%d",
+		byte(version),
+		uint8(version>>8),
+		uint16(version>>16)), ""
+}
+
+// hardware returns the physical memory
+func hardware() omaha.HW {
+	var hw omaha.HW
+	status := memoryStatusEx{}
+	status.length = uint32(unsafe.Sizeof(status))
+	result, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if result != 0 {
+		hw.PhysMemory = memoryGB(status.totalPhys)
+	}
+	return hw
+}
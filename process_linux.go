@@ -0,0 +1,54 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// waitNoReap is WNOWAIT, leaving the exited process waitable
+const waitNoReap = 0x1000000
+
+// setParentDeathSignal kills the target when the OS thread that started it
+// exits. The Go runtime may exit threads at any time, the target is started
+// and waited for on a locked thread so the signal only fires when Unattended
+// dies, see startCommand
+func setParentDeathSignal(attributes *syscall.SysProcAttr) {
+	attributes.Pdeathsig = syscall.SIGKILL
+}
+
+// waitTarget waits for the started command to complete. beforeReap is called
+// once the target exited but before it is reaped, while the ID of its process
+// group can't be reused yet
+func waitTarget(command *exec.Cmd, beforeReap func()) error {
+	// siginfo_t is 128 bytes on all Linux architectures
+	var siginfo [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_WAITID,
+			1, // P_PID
+			uintptr(command.Process.Pid),
+			uintptr(unsafe.Pointer(&siginfo[0])),
+			syscall.WEXITED|waitNoReap,
+			0,
+			0)
+		if errno != syscall.EINTR {
+			break
+		}
+	}
+	beforeReap()
+	return command.Wait()
+}
@@ -0,0 +1,34 @@
+//go:build !linux && !windows && !plan9
+// +build !linux,!windows,!plan9
+
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setParentDeathSignal is only supported on Linux
+func setParentDeathSignal(attributes *syscall.SysProcAttr) {
+}
+
+// waitTarget waits for the started command to complete. Only Linux can wait
+// without reaping the target, beforeReap is called once it is reaped
+func waitTarget(command *exec.Cmd, beforeReap func()) error {
+	err := command.Wait()
+	beforeReap()
+	return err
+}
@@ -0,0 +1,59 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// configureProcess starts the target in its own process group, or session,
+// so that the target and its child processes can be signalled together
+func configureProcess(command *exec.Cmd, target Target) {
+	command.SysProcAttr = &syscall.SysProcAttr{}
+	if target.NewSession {
+		command.SysProcAttr.Setsid = true
+	} else {
+		command.SysProcAttr.Setpgid = true
+	}
+	if target.KillWithSupervisor {
+		setParentDeathSignal(command.SysProcAttr)
+	}
+}
+
+// signalTarget sends the signal to the process group of the target
+func signalTarget(process *os.Process, signal os.Signal) error {
+	unixSignal, ok := signal.(syscall.Signal)
+	if ok == false {
+		return fmt.Errorf("Signal %s is not supported", signal)
+	}
+	return syscall.Kill(-process.Pid, unixSignal)
+}
+
+// killTarget kills the process group of the target
+func (updater *Unattended) killTarget(process *os.Process) error {
+	updater.log.Info("Killing target process group")
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
+
+// cleanupProcessGroup kills any processes left in the process group of the
+// stopped target
+func cleanupProcessGroup(process *os.Process) {
+	syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,62 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// configureProcess starts the target in its own process group
+func configureProcess(command *exec.Cmd, target Target) {
+	command.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
+
+// signalTarget sends the signal to the target. Windows only supports
+// os.Kill, other signals return an error
+func signalTarget(process *os.Process, signal os.Signal) error {
+	return process.Signal(signal)
+}
+
+// killTarget kills the target and its child processes with taskkill
+func (updater *Unattended) killTarget(process *os.Process) error {
+	updater.log.Info("Killing target process tree with taskkill")
+	// Some processes just need to be force killed on Windows, many many
+	// tests showed Windows not killing it when process.Kill is used.
+	// This is especially true when this runs as a service
+	_, err := exec.Command(
+		"taskkill",
+		"/F",   // Force
+		"/T",   // Including child processes
+		"/PID", // by process ID
+		fmt.Sprintf("%d", process.Pid),
+	).Output()
+	return err
+}
+
+// cleanupProcessGroup is not needed on Windows, child processes are killed
+// with the target by taskkill
+func cleanupProcessGroup(process *os.Process) {
+}
+
+// waitTarget waits for the started command to complete and calls beforeReap
+func waitTarget(command *exec.Cmd, beforeReap func()) error {
+	err := command.Wait()
+	beforeReap()
+	return err
+}
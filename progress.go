@@ -0,0 +1,170 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// progressReportInterval is the minimum time between calls of the
+	// progress handler
+	progressReportInterval = time.Second
+	// progressLogInterval is the minimum time between progress log entries
+	progressLogInterval = time.Second * 10
+)
+
+// DownloadProgress describes the progress of a package download
+type DownloadProgress struct {
+	// Package is the name of the package being downloaded
+	Package string
+	// Version of the target in the package
+	Version string
+	// BytesDone is the number of bytes downloaded, including bytes of a
+	// resumed partial download
+	BytesDone int64
+	// BytesTotal is the size of the package, 0 if not known
+	BytesTotal int64
+	// Rate is the download rate in bytes per second
+	Rate float64
+	// ETA is the estimated time until the download completes, 0 if not known
+	ETA time.Duration
+	// Done is set on the last report of a download
+	Done bool
+}
+
+// ProgressHandler is called with the progress of package downloads
+type ProgressHandler func(progress DownloadProgress)
+
+// SetProgressHandler sets the handler called with the progress of package
+// downloads. The handler is called at most once a second and once when the
+// download completes, and must not block
+func (updater *Unattended) SetProgressHandler(handler ProgressHandler) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	updater.progressHandler = handler
+}
+
+// progressTracker calculates and reports the progress of a download
+type progressTracker struct {
+	mutex      sync.Mutex
+	progress   DownloadProgress
+	handler    ProgressHandler
+	log        *logrus.Entry
+	started    time.Time
+	startBytes int64
+	lastReport time.Time
+	lastLog    time.Time
+}
+
+// newProgressTracker creates a tracker for the download of the package
+func (updater *Unattended) newProgressTracker(
+	packageName string,
+	version string,
+	total int64) *progressTracker {
+
+	updater.mutex.Lock()
+	handler := updater.progressHandler
+	updater.mutex.Unlock()
+
+	return &progressTracker{
+		progress: DownloadProgress{
+			Package:    packageName,
+			Version:    version,
+			BytesTotal: total,
+		},
+		handler: handler,
+		log: updater.log.WithFields(logrus.Fields{
+			"package":         packageName,
+			"package_version": version,
+		}),
+	}
+}
+
+// expect sets the size declared for the package, the size reported by the
+// server is used if none is declared
+func (tracker *progressTracker) expect(total int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.progress.BytesTotal = total
+}
+
+// current returns the progress of the download so far
+func (tracker *progressTracker) current() DownloadProgress {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.progress
+}
+
+// start is called when a download attempt starts at the offset. The rate is
+// calculated over the bytes of the attempt
+func (tracker *progressTracker) start(offset int64, total int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.started = time.Now()
+	tracker.startBytes = offset
+	tracker.progress.BytesDone = offset
+	if tracker.progress.BytesTotal == 0 && total > 0 {
+		tracker.progress.BytesTotal = total
+	}
+}
+
+// Write counts the downloaded bytes
+func (tracker *progressTracker) Write(content []byte) (int, error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.progress.BytesDone += int64(len(content))
+	tracker.report(false)
+	return len(content), nil
+}
+
+// finish reports the completed download
+func (tracker *progressTracker) finish() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.progress.Done = true
+	tracker.report(true)
+}
+
+// report calculates the rate and ETA, and reports the progress if the
+// throttle interval passed or force is set
+func (tracker *progressTracker) report(force bool) {
+	now := time.Now()
+	elapsed := now.Sub(tracker.started).Seconds()
+	if elapsed > 0 {
+		tracker.progress.Rate = float64(tracker.progress.BytesDone-tracker.startBytes) / elapsed
+	}
+	tracker.progress.ETA = 0
+	remaining := tracker.progress.BytesTotal - tracker.progress.BytesDone
+	if tracker.progress.Rate > 0 && remaining > 0 {
+		tracker.progress.ETA = time.Duration(float64(remaining) / tracker.progress.Rate * float64(time.Second))
+	}
+
+	if tracker.handler != nil && (force || now.Sub(tracker.lastReport) >= progressReportInterval) {
+		tracker.lastReport = now
+		tracker.handler(tracker.progress)
+	}
+	if force || now.Sub(tracker.lastLog) >= progressLogInterval {
+		tracker.lastLog = now
+		tracker.log.WithFields(logrus.Fields{
+			"bytes_done":  tracker.progress.BytesDone,
+			"bytes_total": tracker.progress.BytesTotal,
+			"rate":        int64(tracker.progress.Rate),
+			"eta":         tracker.progress.ETA.Round(time.Second),
+		}).Info("Download progress")
+	}
+}
@@ -0,0 +1,185 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxExitHistory is the number of exits kept by Unattended
+	maxExitHistory = 20
+)
+
+// RestartMode defines when a completed target is restarted
+type RestartMode int
+
+const (
+	// RestartNever never restarts the target, RunWithoutUpdate returns once
+	// the target completes. This is the default
+	RestartNever RestartMode = iota
+	// RestartOnFailure restarts the target if it exits with a non-zero exit
+	// code, is killed by a signal or fails to start
+	RestartOnFailure
+	// RestartAlways restarts the target whenever it completes
+	RestartAlways
+)
+
+// RestartPolicy defines how the target is restarted once it completes
+// without being stopped
+type RestartPolicy struct {
+	// Mode defines when the target is restarted
+	Mode RestartMode
+	// InitialBackoff is the delay before the first restart, defaults to 1s
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum delay between restarts, defaults to 1m. The
+	// delay doubles after every restart and is reset once the target ran for
+	// at least MaxBackoff
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, the delay is randomly
+	// increased or decreased by
+	Jitter float64
+	// StartLimitBurst is the number of restarts allowed in StartLimitInterval
+	// before giving up, defaults to 5
+	StartLimitBurst int
+	// StartLimitInterval is the interval StartLimitBurst applies to,
+	// defaults to 10s
+	StartLimitInterval time.Duration
+}
+
+// ExitStatus records how the target completed
+type ExitStatus struct {
+	// Version of the target that completed
+	Version string
+	// PID of the target process
+	PID int
+	// Code the target exited with, -1 if killed by a signal
+	Code int
+	// Signal that killed the target, empty if the target exited
+	Signal string
+	// Err is set if the target could not be started or waited for
+	Err error
+	// Time the target completed
+	Time time.Time
+}
+
+// Success returns true if the target exited with exit code 0
+func (status ExitStatus) Success() bool {
+	return status.Err == nil && status.Code == 0 && status.Signal == ""
+}
+
+// SetRestartPolicy sets the policy for restarting the target once it
+// completes. Restarts follow the same path as restarts after an update
+func (updater *Unattended) SetRestartPolicy(policy RestartPolicy) {
+	if policy.InitialBackoff == time.Duration(0) {
+		policy.InitialBackoff = time.Second
+	}
+	if policy.MaxBackoff == time.Duration(0) {
+		policy.MaxBackoff = time.Minute
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	if policy.StartLimitBurst == 0 {
+		policy.StartLimitBurst = 5
+	}
+	if policy.StartLimitInterval == time.Duration(0) {
+		policy.StartLimitInterval = time.Second * 10
+	}
+	updater.mutex.Lock()
+	updater.restartPolicy = policy
+	updater.mutex.Unlock()
+}
+
+// ExitHistory returns the most recent exits of the target, oldest first
+func (updater *Unattended) ExitHistory() []ExitStatus {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	history := make([]ExitStatus, len(updater.exitHistory))
+	copy(history, updater.exitHistory)
+	return history
+}
+
+// recordExit adds the exit status to the exit history
+func (updater *Unattended) recordExit(status ExitStatus) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	updater.exitHistory = append(updater.exitHistory, status)
+	if len(updater.exitHistory) > maxExitHistory {
+		updater.exitHistory = updater.exitHistory[len(updater.exitHistory)-maxExitHistory:]
+	}
+}
+
+// exitStatusFromState creates the exit status of a completed process
+func exitStatusFromState(version string, pid int, state *os.ProcessState, err error) ExitStatus {
+	status := ExitStatus{
+		Version: version,
+		PID:     pid,
+		Code:    -1,
+		Time:    time.Now(),
+	}
+	if state == nil {
+		status.Err = err
+		return status
+	}
+	status.Code = state.ExitCode()
+	if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+		status.Signal = waitStatus.Signal().String()
+	}
+	return status
+}
+
+// shouldRestart returns true if the policy restarts the target after the
+// given exit
+func (policy RestartPolicy) shouldRestart(status ExitStatus) bool {
+	switch policy.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return status.Success() == false
+	}
+	return false
+}
+
+// backoff returns the delay before the given restart attempt, starting at 0
+func (policy RestartPolicy) backoff(attempt int) time.Duration {
+	delay := float64(policy.InitialBackoff) * math.Pow(2, float64(attempt))
+	if delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+	delay += delay * policy.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(delay)
+}
+
+// startLimiter tracks restarts to enforce the start limit of a policy
+type startLimiter struct {
+	starts []time.Time
+}
+
+// allow records a restart and returns false if the start limit was hit
+func (limiter *startLimiter) allow(policy RestartPolicy) bool {
+	now := time.Now()
+	var recent []time.Time
+	for _, start := range limiter.starts {
+		if now.Sub(start) < policy.StartLimitInterval {
+			recent = append(recent, start)
+		}
+	}
+	limiter.starts = append(recent, now)
+	return len(limiter.starts) <= policy.StartLimitBurst
+}
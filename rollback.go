@@ -0,0 +1,232 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultProbationPeriod is the probation period used if none is set
+	// on the target
+	DefaultProbationPeriod = time.Second * 30
+	// badVersionsFileName is the state file listing versions that failed
+	badVersionsFileName = "bad_versions.json"
+)
+
+// BadVersion is a version that failed probation and was rolled back
+type BadVersion struct {
+	// Version that failed
+	Version string `json:"version"`
+	// Reason the version failed
+	Reason string `json:"reason"`
+	// Time the version was marked as bad
+	Time time.Time `json:"time"`
+}
+
+// BadVersions returns the versions that failed probation. Bad versions are
+// never selected by LatestVersion
+func (target *Target) BadVersions() []BadVersion {
+	return readBadVersions(target.VersionsPath, target.logger())
+}
+
+// badVersions returns the bad versions as a set
+func (target *Target) badVersions() map[string]bool {
+	return badVersionSet(target.VersionsPath, target.logger())
+}
+
+// markBadVersion records the version as bad on disk
+func (target *Target) markBadVersion(version string, reason error) error {
+	return markBadVersion(target.VersionsPath, version, reason)
+}
+
+// readBadVersions returns the bad versions recorded in the versions path
+func readBadVersions(versionsPath string, log *logrus.Entry) []BadVersion {
+	var versions []BadVersion
+	content, err := ioutil.ReadFile(statePath(versionsPath, badVersionsFileName))
+	if err != nil {
+		return versions
+	}
+	err = json.Unmarshal(content, &versions)
+	if err != nil {
+		log.Warningf("Unable to read bad versions: %s", err)
+	}
+	return versions
+}
+
+// badVersionSet returns the bad versions recorded in the versions path as
+// a set
+func badVersionSet(versionsPath string, log *logrus.Entry) map[string]bool {
+	versions := make(map[string]bool)
+	for _, version := range readBadVersions(versionsPath, log) {
+		versions[version.Version] = true
+	}
+	return versions
+}
+
+// markBadVersion records the version as bad in the versions path. A version
+// that failed before is updated with the latest reason
+func markBadVersion(versionsPath string, version string, reason error) error {
+	badVersion := BadVersion{
+		Version: version,
+		Reason:  reason.Error(),
+		Time:    time.Now().UTC(),
+	}
+	versions := readBadVersions(versionsPath, logrus.NewEntry(logrus.StandardLogger()))
+	marked := false
+	for i := range versions {
+		if versions[i].Version == version {
+			versions[i] = badVersion
+			marked = true
+		}
+	}
+	if marked == false {
+		versions = append(versions, badVersion)
+	}
+	content, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statePath(versionsPath, badVersionsFileName), content)
+}
+
+// markNewerVersionsBad marks the installed versions newer than the version
+// as bad, the server rolled the installation back to the version
+func (updater *Unattended) markNewerVersionsBad(installation installation, version string) error {
+	rollbackVersion, err := installation.scheme.Parse(version)
+	if err != nil {
+		return err
+	}
+	badVersions := badVersionSet(installation.versionsPath, updater.log)
+	for _, installed := range installedVersions(installation.versionsPath, installation.scheme, updater.log) {
+		if badVersions[installed.String()] || installed.Compare(rollbackVersion) <= 0 {
+			continue
+		}
+		updater.log.WithFields(logrus.Fields{
+			"app_id":  installation.appID,
+			"version": installed.String(),
+		}).Info("Marking version as bad, rolled back by the server")
+		err := markBadVersion(
+			installation.versionsPath,
+			installed.String(),
+			fmt.Errorf("Rolled back to %s by the server", version))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitProbation waits for the probation period of a freshly updated version
+// and until it is healthy. It returns an error if the version failed during
+// probation
+func (updater *Unattended) waitProbation(
+	version string,
+	exited chan struct{},
+	monitor *healthMonitor) error {
+
+	updater.log.WithFields(logrus.Fields{
+		"version":   version,
+		"probation": updater.target.ProbationPeriod,
+	}).Info("New version on probation")
+
+	timer := time.NewTimer(updater.target.ProbationPeriod)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		return fmt.Errorf("Target exited during probation")
+	case err := <-monitor.unhealthy:
+		return err
+	case <-timer.C:
+	}
+
+	// The update is only successful once the new version is healthy
+	select {
+	case <-exited:
+		return fmt.Errorf("Target exited during probation")
+	case err := <-monitor.unhealthy:
+		return err
+	case <-monitor.healthy:
+	}
+
+	updater.log.WithField("version", version).Info("New version passed probation")
+	return nil
+}
+
+// rollback stops the failed version, marks it as bad and reports the
+// rollback to the server with the error code. The previous version is
+// started by RunWithoutUpdate
+func (updater *Unattended) rollback(version string, errorCode int, reason error) error {
+	updater.log.WithFields(logrus.Fields{
+		"version": version,
+		"reason":  reason,
+	}).Error("New version failed, rolling back")
+
+	err := updater.stopTarget()
+	if err != nil {
+		updater.log.Warningf("Unable to stop failed version: %s", err)
+	}
+	updater.waitCompleted()
+
+	err = updater.target.markBadVersion(version, reason)
+	if err != nil {
+		return fmt.Errorf("Unable to mark version %s as bad: %s", version, err)
+	}
+
+	previousVersion := updater.target.LatestVersion()
+	updater.reportEvent(updater.targetInstallation(), version, omaha.Event{
+		Type:            omaha.EventTypeRollback,
+		Result:          omaha.EventResultTypeSuccess,
+		ErrorCode:       errorCode,
+		PreviousVersion: version,
+		NextVersion:     previousVersion,
+	})
+
+	updater.log.WithField(
+		"version", previousVersion,
+	).Info("Rolling back to previous version")
+	return nil
+}
+
+// waitCompleted blocks until the target application has completed
+func (updater *Unattended) waitCompleted() {
+	updater.mutex.Lock()
+	exited := updater.exited
+	updater.mutex.Unlock()
+	if exited != nil {
+		<-exited
+	}
+}
+
+// writeFileAtomic writes the file by renaming a temporary file into place
+func writeFileAtomic(path string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	err = ioutil.WriteFile(tempPath, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
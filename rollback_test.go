@@ -0,0 +1,44 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMarkBadVersionOnce(t *testing.T) {
+	updater := newTestUpdater(t, Target{})
+	for _, reason := range []string{"first failure", "second failure"} {
+		err := updater.target.markBadVersion("1.0.0.0", errors.New(reason))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := updater.target.markBadVersion("2.0.0.0", errors.New("other failure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := updater.target.BadVersions()
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 bad versions, got %d", len(versions))
+	}
+	if versions[0].Version != "1.0.0.0" || versions[0].Reason != "second failure" {
+		t.Fatalf("Expected the latest failure of 1.0.0.0, got %+v", versions[0])
+	}
+	if versions[1].Version != "2.0.0.0" {
+		t.Fatalf("Expected 2.0.0.0, got %+v", versions[1])
+	}
+}
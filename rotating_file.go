@@ -0,0 +1,411 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// rotatedTimeFormat is the time format used in the names of rotated files
+	rotatedTimeFormat = "20060102T150405.000"
+)
+
+// VersionedWriter is implemented by output writers that need to know the
+// version of the target writing to them. Unattended calls SetVersion
+// before the target is started
+type VersionedWriter interface {
+	io.Writer
+	// SetVersion sets the version of the target being written
+	SetVersion(version string) error
+}
+
+// RotatingFileOptions defines the file and rotation of a RotatingFile
+type RotatingFileOptions struct {
+	// Path of the file to write to
+	Path string
+	// MaxSize in bytes after which the file is rotated, 0 disables size
+	// based rotation
+	MaxSize int64
+	// RotateEvery is the time after which the file is rotated, 0 disables
+	// time based rotation
+	RotateEvery time.Duration
+	// MaxFiles is the number of rotated files kept, 0 keeps all
+	MaxFiles int
+	// Compress the rotated files with gzip
+	Compress bool
+	// PerVersion writes the file to a subdirectory named after the version
+	// of the target
+	PerVersion bool
+}
+
+// RotatingFile is an output writer that writes to a file that is rotated by
+// size and time. The file is reopened when the process receives SIGHUP
+type RotatingFile struct {
+	mutex   sync.Mutex
+	options RotatingFileOptions
+	version string
+	file    *os.File
+	size    int64
+	// startedAt is the time the first line was written to the file at
+	// startedPath, it is kept when the same file is opened again
+	startedAt   time.Time
+	startedPath string
+	closed      bool
+	signals     chan os.Signal
+	done        chan struct{}
+	waitGroup   sync.WaitGroup
+}
+
+// NewRotatingFile creates the rotating file and opens it for writing
+func NewRotatingFile(options RotatingFileOptions) (*RotatingFile, error) {
+	if options.Path == "" {
+		return nil, fmt.Errorf("Rotating file path is not set")
+	}
+	rotatingFile := &RotatingFile{
+		options: options,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	err := rotatingFile.open()
+	if err != nil {
+		return nil, err
+	}
+
+	signal.Notify(rotatingFile.signals, syscall.SIGHUP)
+	rotatingFile.waitGroup.Add(1)
+	go func() {
+		defer rotatingFile.waitGroup.Done()
+		for {
+			select {
+			case <-rotatingFile.signals:
+				rotatingFile.Reopen()
+			case <-rotatingFile.done:
+				return
+			}
+		}
+	}()
+
+	return rotatingFile, nil
+}
+
+// Write writes to the file, rotating it first if needed
+func (rotatingFile *RotatingFile) Write(content []byte) (int, error) {
+	rotatingFile.mutex.Lock()
+	defer rotatingFile.mutex.Unlock()
+
+	if rotatingFile.closed {
+		return 0, fmt.Errorf("Rotating file is closed")
+	}
+	if rotatingFile.file == nil {
+		// A previous open failed, try again
+		err := rotatingFile.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if rotatingFile.shouldRotate(int64(len(content))) {
+		err := rotatingFile.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	written, err := rotatingFile.file.Write(content)
+	if written > 0 && rotatingFile.startedAt.IsZero() {
+		rotatingFile.startedAt = time.Now()
+	}
+	rotatingFile.size += int64(written)
+	return written, err
+}
+
+// SetVersion sets the version of the target. With PerVersion set the file
+// is reopened in the directory of the version, opening it is retried on the
+// next write if it fails
+func (rotatingFile *RotatingFile) SetVersion(version string) error {
+	rotatingFile.mutex.Lock()
+	defer rotatingFile.mutex.Unlock()
+
+	if rotatingFile.version == version {
+		return nil
+	}
+	rotatingFile.version = version
+	if rotatingFile.options.PerVersion == false || rotatingFile.closed {
+		return nil
+	}
+	if rotatingFile.file != nil {
+		rotatingFile.file.Close()
+		rotatingFile.file = nil
+	}
+	return rotatingFile.open()
+}
+
+// Rotate the file now
+func (rotatingFile *RotatingFile) Rotate() error {
+	rotatingFile.mutex.Lock()
+	defer rotatingFile.mutex.Unlock()
+
+	if rotatingFile.closed {
+		return fmt.Errorf("Rotating file is closed")
+	}
+	return rotatingFile.rotate()
+}
+
+// Reopen closes and opens the file, used after the file was moved by an
+// external tool such as logrotate
+func (rotatingFile *RotatingFile) Reopen() error {
+	rotatingFile.mutex.Lock()
+	defer rotatingFile.mutex.Unlock()
+
+	if rotatingFile.closed {
+		return nil
+	}
+	if rotatingFile.file != nil {
+		rotatingFile.file.Close()
+	}
+	return rotatingFile.open()
+}
+
+// Close the file and wait for rotated files to be compressed
+func (rotatingFile *RotatingFile) Close() error {
+	rotatingFile.mutex.Lock()
+	defer func() {
+		rotatingFile.waitGroup.Wait()
+	}()
+	defer rotatingFile.mutex.Unlock()
+
+	if rotatingFile.closed {
+		return nil
+	}
+	rotatingFile.closed = true
+	signal.Stop(rotatingFile.signals)
+	close(rotatingFile.done)
+	if rotatingFile.file == nil {
+		return nil
+	}
+	err := rotatingFile.file.Close()
+	rotatingFile.file = nil
+	return err
+}
+
+// path returns the path of the file being written
+func (rotatingFile *RotatingFile) path() string {
+	if rotatingFile.options.PerVersion && rotatingFile.version != "" {
+		return filepath.Join(
+			filepath.Dir(rotatingFile.options.Path),
+			rotatingFile.version,
+			filepath.Base(rotatingFile.options.Path))
+	}
+	return rotatingFile.options.Path
+}
+
+// open opens the file for appending
+func (rotatingFile *RotatingFile) open() error {
+	path := rotatingFile.path()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		rotatingFile.file = nil
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		rotatingFile.file = nil
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		rotatingFile.file = nil
+		return err
+	}
+
+	rotatingFile.file = file
+	rotatingFile.size = info.Size()
+	switch {
+	case info.Size() == 0:
+		// The age of the file counts from its first write
+		rotatingFile.startedAt = time.Time{}
+	case path != rotatingFile.startedPath || rotatingFile.startedAt.IsZero():
+		// The file was written before it was opened, it is at least as old
+		// as its last write
+		rotatingFile.startedAt = info.ModTime()
+	}
+	rotatingFile.startedPath = path
+	return nil
+}
+
+// shouldRotate returns true if writing the given length requires rotation
+func (rotatingFile *RotatingFile) shouldRotate(length int64) bool {
+	if rotatingFile.size == 0 {
+		return false
+	}
+	if rotatingFile.options.MaxSize > 0 &&
+		rotatingFile.size+length > rotatingFile.options.MaxSize {
+		return true
+	}
+	if rotatingFile.options.RotateEvery > 0 &&
+		time.Since(rotatingFile.startedAt) >= rotatingFile.options.RotateEvery {
+		return true
+	}
+	return false
+}
+
+// rotate moves the current file aside and opens a new file
+func (rotatingFile *RotatingFile) rotate() error {
+	path := rotatingFile.path()
+	if rotatingFile.file != nil {
+		rotatingFile.file.Close()
+		rotatingFile.file = nil
+	}
+
+	rotatedPath := rotatingFile.rotatedPath(path)
+	err := os.Rename(path, rotatedPath)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	err = rotatingFile.open()
+	if err != nil {
+		return err
+	}
+
+	// Compression and cleanup happen in the background to not block the
+	// target's output
+	rotatingFile.waitGroup.Add(1)
+	go func() {
+		defer rotatingFile.waitGroup.Done()
+		if rotatingFile.options.Compress {
+			compressFile(rotatedPath)
+		}
+		removeOldFiles(path, rotatingFile.options.MaxFiles)
+	}()
+	return nil
+}
+
+// rotatedPath returns an unused path for the rotated file
+func (rotatingFile *RotatingFile) rotatedPath(path string) string {
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+	timestamp := time.Now().Format(rotatedTimeFormat)
+
+	rotatedPath := fmt.Sprintf("%s-%s%s", base, timestamp, extension)
+	for i := 1; fileExists(rotatedPath) || fileExists(rotatedPath+".gz"); i++ {
+		rotatedPath = fmt.Sprintf("%s-%s.%d%s", base, timestamp, i, extension)
+	}
+	return rotatedPath
+}
+
+// compressFile replaces the file with a gzip compressed copy
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	gzWriter := gzip.NewWriter(destination)
+	_, err = io.Copy(gzWriter, source)
+	if err == nil {
+		err = gzWriter.Close()
+	}
+	closeErr := destination.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	source.Close()
+	return os.Remove(path)
+}
+
+// removeOldFiles removes the oldest rotated files of the path, keeping
+// maxFiles. 0 keeps all files
+func removeOldFiles(path string, maxFiles int) {
+	if maxFiles <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, file := range files {
+		if file.IsDir() || isRotatedName(path, file.Name()) == false {
+			continue
+		}
+		rotated = append(rotated, file.Name())
+	}
+	// The timestamp in the name sorts the files from oldest to newest
+	sort.Strings(rotated)
+	for len(rotated) > maxFiles {
+		os.Remove(filepath.Join(filepath.Dir(path), rotated[0]))
+		rotated = rotated[1:]
+	}
+}
+
+// isRotatedName returns true if the name is the name of a rotated file of
+// the path, as returned by rotatedPath and optionally compressed
+func isRotatedName(path string, name string) bool {
+	extension := filepath.Ext(path)
+	prefix := filepath.Base(strings.TrimSuffix(path, extension)) + "-"
+
+	name = strings.TrimSuffix(name, ".gz")
+	if strings.HasPrefix(name, prefix) == false ||
+		strings.HasSuffix(name, extension) == false ||
+		len(name) < len(prefix)+len(extension)+len(rotatedTimeFormat) {
+		return false
+	}
+	suffix := strings.TrimSuffix(strings.TrimPrefix(name, prefix), extension)
+	_, err := time.Parse(rotatedTimeFormat, suffix[:len(rotatedTimeFormat)])
+	if err != nil {
+		return false
+	}
+	// Files rotated within the same millisecond are numbered
+	counter := suffix[len(rotatedTimeFormat):]
+	if counter == "" {
+		return true
+	}
+	if len(counter) < 2 || counter[0] != '.' {
+		return false
+	}
+	for _, digit := range counter[1:] {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// fileExists returns true if the path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
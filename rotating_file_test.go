@@ -0,0 +1,121 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsRotatedName(t *testing.T) {
+	tests := []struct {
+		name    string
+		rotated bool
+	}{
+		{name: "app-20180102T150405.000.log", rotated: true},
+		{name: "app-20180102T150405.000.log.gz", rotated: true},
+		{name: "app-20180102T150405.000.2.log", rotated: true},
+		{name: "app.log"},
+		{name: "app-error.log"},
+		{name: "app-backup-20180102T150405.000.log"},
+		{name: "app-20180102T150405.000.log.bak"},
+		{name: "app-20180102T150405.000.x.log"},
+		{name: "app-20181302T150405.000.log"},
+	}
+
+	for _, test := range tests {
+		rotated := isRotatedName(filepath.Join("logs", "app.log"), test.name)
+		if rotated != test.rotated {
+			t.Errorf("Expected '%s' rotated to be %t", test.name, test.rotated)
+		}
+	}
+}
+
+func TestRemoveOldFilesKeepsOtherFiles(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "app.log")
+	names := []string{
+		"app-20180101T000000.000.log.gz",
+		"app-20180102T000000.000.log.gz",
+		"app-20180103T000000.000.log",
+		"app-error.log",
+		"app-archive.log",
+	}
+	for _, name := range names {
+		err := ioutil.WriteFile(filepath.Join(directory, name), []byte("line\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeOldFiles(path, 1)
+
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, file := range files {
+		remaining = append(remaining, file.Name())
+	}
+	expected := []string{"app-20180103T000000.000.log", "app-archive.log", "app-error.log"}
+	if len(remaining) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, remaining)
+	}
+	for i := range expected {
+		if remaining[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, remaining)
+		}
+	}
+}
+
+func TestRotateEveryKeptOnReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	rotatingFile, err := NewRotatingFile(RotatingFileOptions{
+		Path:        path,
+		RotateEvery: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotatingFile.Close()
+
+	_, err = rotatingFile.Write([]byte("first\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file was started longer than RotateEvery ago
+	rotatingFile.mutex.Lock()
+	rotatingFile.startedAt = time.Now().Add(-2 * time.Hour)
+	rotatingFile.mutex.Unlock()
+
+	err = rotatingFile.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rotatingFile.Write([]byte("second\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "second\n" {
+		t.Fatalf("Expected the file to be rotated, got '%s'", content)
+	}
+}
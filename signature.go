@@ -0,0 +1,235 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// signatureExtension is appended to the download URL of a package to
+	// get its detached signature when the manifest has none
+	signatureExtension = ".sig"
+	// maxSignatureFileSize is the maximum size of a detached signature file
+	maxSignatureFileSize = 4096
+
+	// ResponseSignatureHeader is the HTTP header holding the base64 encoded
+	// Ed25519 signature of the response body
+	ResponseSignatureHeader = "X-Unattended-Signature"
+)
+
+var (
+	// ErrSignatureMissing is returned when a keyring is configured and the
+	// package is not signed
+	ErrSignatureMissing = errors.New("Package is not signed")
+	// ErrSignatureInvalid is returned when a signature is not valid for any
+	// of the trusted keys
+	ErrSignatureInvalid = errors.New("Signature is not valid for any trusted key")
+	// ErrResponseNotSigned is returned when a response keyring is configured
+	// and the update response is not signed
+	ErrResponseNotSigned = errors.New("Response is not signed")
+)
+
+// Keyring contains trusted Ed25519 public keys. A signature is accepted if
+// any of the trusted keys that is not revoked made it, allowing keys to be
+// rotated
+type Keyring struct {
+	// TrustedKeys are the keys accepted for signatures
+	TrustedKeys []ed25519.PublicKey
+	// RevokedKeys are never accepted, even if they are trusted
+	RevokedKeys []ed25519.PublicKey
+}
+
+// ParsePublicKey parses a base64 or hex encoded Ed25519 public key
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	encoded = strings.TrimSpace(encoded)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		key, err = hex.DecodeString(encoded)
+	}
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid Ed25519 public key '%s'", encoded)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Verify the signature of the message. It returns the key that made the
+// signature, or ErrSignatureInvalid
+func (keyring *Keyring) Verify(message []byte, signature []byte) (ed25519.PublicKey, error) {
+	if len(signature) != ed25519.SignatureSize {
+		return nil, ErrSignatureInvalid
+	}
+	for _, key := range keyring.TrustedKeys {
+		if len(key) != ed25519.PublicKeySize || keyring.isRevoked(key) {
+			continue
+		}
+		if ed25519.Verify(key, message, signature) {
+			return key, nil
+		}
+	}
+	return nil, ErrSignatureInvalid
+}
+
+// isRevoked returns true if the key is in the revocation list
+func (keyring *Keyring) isRevoked(key ed25519.PublicKey) bool {
+	for _, revoked := range keyring.RevokedKeys {
+		if bytes.Equal(key, revoked) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPackageSignature verifies the signature of the package against the
+// keyring of the target. The signature is made over the SHA-256 digest of
+// the package
+func (updater *Unattended) verifyPackageSignature(
+	ctx context.Context,
+	manifest omaha.Manifest,
+	digest []byte) error {
+
+	keyring := updater.target.Keyring
+	if keyring == nil {
+		return nil
+	}
+
+	signature, err := updater.packageSignature(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	key, err := keyring.Verify(digest, signature)
+	if err != nil {
+		return err
+	}
+	updater.log.WithFields(logrus.Fields{
+		"package": manifest.Package.Name,
+		"key":     base64.StdEncoding.EncodeToString(key),
+	}).Debug("Package signature verified")
+	return nil
+}
+
+// packageSignature returns the signature from the manifest, or the detached
+// signature file next to the package
+func (updater *Unattended) packageSignature(
+	ctx context.Context,
+	manifest omaha.Manifest) ([]byte, error) {
+
+	if manifest.Package.Signature != "" {
+		return decodeSignature([]byte(manifest.Package.Signature))
+	}
+
+	signatureURL, err := url.Parse(manifest.DownloadURL.Codebase)
+	if err != nil {
+		return nil, err
+	}
+	signatureURL.Path += signatureExtension
+
+	request, err := http.NewRequest(http.MethodGet, signatureURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download signature: %s", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrSignatureMissing
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"Unable to download signature, received HTTP status code %d",
+			response.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, maxSignatureFileSize))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download signature: %s", err)
+	}
+	return decodeSignature(content)
+}
+
+// decodeSignature decodes a raw or base64 encoded signature
+func decodeSignature(content []byte) ([]byte, error) {
+	if len(content) == ed25519.SignatureSize {
+		return content, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode signature: %s", err)
+	}
+	return signature, nil
+}
+
+// verifyResponse authenticates the update response when a response keyring
+// is configured. The body must be signed by a trusted key, echo the ID of
+// the request and not be expired
+func (updater *Unattended) verifyResponse(
+	omahaRequest omaha.Request,
+	omahaResponse omaha.Response,
+	body []byte,
+	header http.Header) error {
+
+	keyring := updater.target.ResponseKeyring
+	if keyring == nil {
+		return nil
+	}
+
+	encoded := header.Get(ResponseSignatureHeader)
+	if encoded == "" {
+		return ErrResponseNotSigned
+	}
+	signature, err := decodeSignature([]byte(encoded))
+	if err != nil {
+		return err
+	}
+	_, err = keyring.Verify(body, signature)
+	if err != nil {
+		return err
+	}
+
+	// The signature only proves the server created the response, the
+	// request ID and expiry prove it was created for this request
+	if omahaResponse.RequestID != omahaRequest.RequestID {
+		return fmt.Errorf(
+			"Response is for request '%s', expected '%s'",
+			omahaResponse.RequestID,
+			omahaRequest.RequestID)
+	}
+	if omahaResponse.Expires == "" {
+		return fmt.Errorf("Response has no expiry")
+	}
+	expires, err := time.Parse(time.RFC3339, omahaResponse.Expires)
+	if err != nil {
+		return fmt.Errorf("Response has an invalid expiry: %s", err)
+	}
+	if time.Now().After(expires) {
+		return fmt.Errorf("Response expired at %s", omahaResponse.Expires)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/omaha"
+)
+
+// newTestKey generates an Ed25519 key pair
+func newTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldPublic, oldPrivate := newTestKey(t)
+	newPublic, newPrivate := newTestKey(t)
+	message := []byte("package digest")
+
+	tests := []struct {
+		name     string
+		keyring  Keyring
+		signedBy ed25519.PrivateKey
+		key      ed25519.PublicKey
+	}{
+		{
+			name:     "old key before rotation",
+			keyring:  Keyring{TrustedKeys: []ed25519.PublicKey{oldPublic}},
+			signedBy: oldPrivate,
+			key:      oldPublic,
+		},
+		{
+			name:     "new key before rotation",
+			keyring:  Keyring{TrustedKeys: []ed25519.PublicKey{oldPublic}},
+			signedBy: newPrivate,
+		},
+		{
+			name:     "old key during rotation",
+			keyring:  Keyring{TrustedKeys: []ed25519.PublicKey{oldPublic, newPublic}},
+			signedBy: oldPrivate,
+			key:      oldPublic,
+		},
+		{
+			name:     "new key during rotation",
+			keyring:  Keyring{TrustedKeys: []ed25519.PublicKey{oldPublic, newPublic}},
+			signedBy: newPrivate,
+			key:      newPublic,
+		},
+		{
+			name:     "old key after rotation",
+			keyring:  Keyring{TrustedKeys: []ed25519.PublicKey{newPublic}},
+			signedBy: oldPrivate,
+		},
+		{
+			name:     "new key after rotation",
+			keyring:  Keyring{TrustedKeys: []ed25519.PublicKey{newPublic}},
+			signedBy: newPrivate,
+			key:      newPublic,
+		},
+		{
+			name: "revoked key still trusted",
+			keyring: Keyring{
+				TrustedKeys: []ed25519.PublicKey{oldPublic, newPublic},
+				RevokedKeys: []ed25519.PublicKey{oldPublic},
+			},
+			signedBy: oldPrivate,
+		},
+		{
+			name: "other key while one is revoked",
+			keyring: Keyring{
+				TrustedKeys: []ed25519.PublicKey{oldPublic, newPublic},
+				RevokedKeys: []ed25519.PublicKey{oldPublic},
+			},
+			signedBy: newPrivate,
+			key:      newPublic,
+		},
+		{
+			name: "all keys revoked",
+			keyring: Keyring{
+				TrustedKeys: []ed25519.PublicKey{newPublic},
+				RevokedKeys: []ed25519.PublicKey{newPublic},
+			},
+			signedBy: newPrivate,
+		},
+		{
+			name:     "no trusted keys",
+			keyring:  Keyring{},
+			signedBy: newPrivate,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := test.keyring.Verify(message, ed25519.Sign(test.signedBy, message))
+			if test.key == nil {
+				if err != ErrSignatureInvalid {
+					t.Fatalf("Expected %s, got %v", ErrSignatureInvalid, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if bytes.Equal(key, test.key) == false {
+				t.Fatalf("Expected the signature to be made by the other key")
+			}
+		})
+	}
+}
+
+func TestKeyringRejectsInvalidSignatures(t *testing.T) {
+	public, private := newTestKey(t)
+	keyring := Keyring{TrustedKeys: []ed25519.PublicKey{public}}
+	message := []byte("package digest")
+	signature := ed25519.Sign(private, message)
+
+	tampered := append([]byte{}, signature...)
+	tampered[0] ^= 0xff
+	tests := map[string]struct {
+		message   []byte
+		signature []byte
+	}{
+		"other message":      {message: []byte("other digest"), signature: signature},
+		"tampered signature": {message: message, signature: tampered},
+		"short signature":    {message: message, signature: signature[:ed25519.SignatureSize-1]},
+		"empty signature":    {message: message},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := keyring.Verify(test.message, test.signature)
+			if err != ErrSignatureInvalid {
+				t.Fatalf("Expected %s, got %v", ErrSignatureInvalid, err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	public, _ := newTestKey(t)
+	for _, encoded := range []string{
+		base64.StdEncoding.EncodeToString(public),
+		hex.EncodeToString(public),
+		" " + hex.EncodeToString(public) + "\n",
+	} {
+		key, err := ParsePublicKey(encoded)
+		if err != nil {
+			t.Fatalf("Unable to parse '%s': %s", encoded, err)
+		}
+		if bytes.Equal(key, public) == false {
+			t.Fatalf("Parsed '%s' to the wrong key", encoded)
+		}
+	}
+	for _, encoded := range []string{"", "not a key", hex.EncodeToString(public[:16])} {
+		_, err := ParsePublicKey(encoded)
+		if err == nil {
+			t.Fatalf("Expected '%s' to be invalid", encoded)
+		}
+	}
+}
+
+func TestVerifyPackageSignatureRevocation(t *testing.T) {
+	oldPublic, oldPrivate := newTestKey(t)
+	newPublic, newPrivate := newTestKey(t)
+	digest := sha256.Sum256([]byte("package"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		signedBy ed25519.PrivateKey
+		reason   error
+	}{
+		{name: "signed by the new key", signedBy: newPrivate},
+		{name: "signed by the revoked key", signedBy: oldPrivate, reason: ErrSignatureInvalid},
+		{name: "not signed", reason: ErrSignatureMissing},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updater := newTestUpdater(t, Target{
+				Keyring: &Keyring{
+					TrustedKeys: []ed25519.PublicKey{oldPublic, newPublic},
+					RevokedKeys: []ed25519.PublicKey{oldPublic},
+				},
+			})
+			manifest := omaha.Manifest{
+				DownloadURL: omaha.URL{Codebase: server.URL + "/package.tar.gz"},
+				Package:     omaha.Package{Name: "package.tar.gz"},
+			}
+			if test.signedBy != nil {
+				manifest.Package.Signature = base64.StdEncoding.EncodeToString(
+					ed25519.Sign(test.signedBy, digest[:]))
+			}
+			err := updater.verifyPackageSignature(context.Background(), manifest, digest[:])
+			if test.reason == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				return
+			}
+			if errors.Is(err, test.reason) == false {
+				t.Fatalf("Expected %s, got %v", test.reason, err)
+			}
+		})
+	}
+}
+
+func TestUpdateCheckVerifiesResponse(t *testing.T) {
+	public, private := newTestKey(t)
+	_, otherPrivate := newTestKey(t)
+
+	tests := []struct {
+		name      string
+		signedBy  ed25519.PrivateKey
+		requestID string
+		expires   time.Duration
+		version   string
+		rollback  bool
+		err       string
+		updates   int
+	}{
+		{name: "valid", signedBy: private, expires: time.Minute, version: "3.0.0.0", updates: 1},
+		{name: "signed by an untrusted key", signedBy: otherPrivate, expires: time.Minute, version: "3.0.0.0", err: ErrSignatureInvalid.Error()},
+		{name: "not signed", expires: time.Minute, version: "3.0.0.0", err: ErrResponseNotSigned.Error()},
+		{name: "other request", signedBy: private, requestID: "other", expires: time.Minute, version: "3.0.0.0", err: "Response is for request 'other'"},
+		{name: "expired", signedBy: private, expires: -time.Minute, version: "3.0.0.0", err: "Response expired"},
+		{name: "downgrade", signedBy: private, expires: time.Minute, version: "1.0.0.0"},
+		{name: "rollback", signedBy: private, expires: time.Minute, version: "1.0.0.0", rollback: true, updates: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var request omaha.Request
+				err := xml.NewDecoder(r.Body).Decode(&request)
+				if err != nil {
+					t.Errorf("Unable to decode request: %s", err)
+				}
+				requestID := request.RequestID
+				if test.requestID != "" {
+					requestID = test.requestID
+				}
+				body, err := xml.Marshal(omaha.Response{
+					Protocol:  3,
+					RequestID: requestID,
+					Expires:   time.Now().Add(test.expires).Format(time.RFC3339),
+					Applications: []omaha.App{{
+						ID:     "test-app",
+						Status: "ok",
+						UpdateCheck: &omaha.UpdateCheck{
+							Status:   "ok",
+							Rollback: test.rollback,
+							Manifest: omaha.Manifest{
+								Version:     test.version,
+								DownloadURL: omaha.URL{Codebase: "http://localhost/"},
+								Package:     omaha.Package{Name: "package.tar.gz"},
+							},
+						},
+					}},
+				})
+				if err != nil {
+					t.Errorf("Unable to encode response: %s", err)
+				}
+				if test.signedBy != nil {
+					w.Header().Set(
+						ResponseSignatureHeader,
+						base64.StdEncoding.EncodeToString(ed25519.Sign(test.signedBy, body)))
+				}
+				w.Write(body)
+			}))
+			defer server.Close()
+
+			updater := newTestUpdater(t, Target{
+				AppID:           "test-app",
+				UpdateEndpoint:  server.URL,
+				ResponseKeyring: &Keyring{TrustedKeys: []ed25519.PublicKey{public}},
+			})
+			err := os.MkdirAll(filepath.Join(updater.target.VersionsPath, "2.0.0.0"), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			updates, err := updater.getAvailableUpdates(context.Background())
+			if test.err != "" {
+				if err == nil || strings.Contains(err.Error(), test.err) == false {
+					t.Fatalf("Expected '%s', got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if len(updates) != test.updates {
+				t.Fatalf("Expected %d updates, got %d", test.updates, len(updates))
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStopGracePeriod is the grace period used if none is set on the
+	// target's StopPolicy
+	DefaultStopGracePeriod = time.Second * 10
+	// DefaultShutdownHookTimeout is the shutdown hook timeout used if none is
+	// set on the target's StopPolicy
+	DefaultShutdownHookTimeout = time.Second * 10
+)
+
+// StopPolicy defines how the target is stopped. The shutdown hook is called
+// first, followed by Signal. If the target has not completed after the
+// grace period it is killed
+type StopPolicy struct {
+	// Signal sent to stop the target, for example syscall.SIGINT,
+	// syscall.SIGHUP or a custom signal. Defaults to syscall.SIGTERM. If the
+	// signal is not supported by the platform the target is killed
+	// immediately
+	Signal os.Signal
+	// GracePeriod to wait for the target to complete after Signal is sent,
+	// defaults to DefaultStopGracePeriod
+	GracePeriod time.Duration
+	// ShutdownHook is called to prepare the target for shutdown before
+	// Signal is sent
+	ShutdownHook ShutdownHook
+	// ShutdownHookTimeout is the time allowed for ShutdownHook, defaults to
+	// DefaultShutdownHookTimeout
+	ShutdownHookTimeout time.Duration
+}
+
+// ShutdownHook prepares the target to be stopped, for example by draining
+// connections
+type ShutdownHook interface {
+	// PrepareShutdown is called before the target is signalled to stop. The
+	// context is cancelled once the hook timeout expires
+	PrepareShutdown(ctx context.Context, process TargetProcess) error
+}
+
+// HTTPShutdownHook prepares the target for shutdown with an HTTP request
+type HTTPShutdownHook struct {
+	// URL to request
+	URL string
+	// Method of the request, defaults to POST
+	Method string
+}
+
+// PrepareShutdown sends the request and expects a 2xx status code
+func (hook HTTPShutdownHook) PrepareShutdown(ctx context.Context, process TargetProcess) error {
+	method := hook.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	request, err := http.NewRequest(method, hook.URL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Received HTTP status code %d", response.StatusCode)
+	}
+	return nil
+}
+
+// CommandShutdownHook prepares the target for shutdown by executing a
+// command. The command must exit with status 0
+type CommandShutdownHook struct {
+	// Command to execute
+	Command string
+	// Arguments to execute the command with
+	Arguments []string
+}
+
+// PrepareShutdown executes the command
+func (hook CommandShutdownHook) PrepareShutdown(ctx context.Context, process TargetProcess) error {
+	output, err := exec.CommandContext(ctx, hook.Command, hook.Arguments...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+	return nil
+}
+
+// stopGracefully calls the shutdown hook and signals the target as defined
+// by the StopPolicy. It returns true if the target completed in the grace
+// period
+func (updater *Unattended) stopGracefully(
+	cmd *exec.Cmd,
+	process TargetProcess,
+	exited chan struct{}) bool {
+
+	policy := updater.target.StopPolicy
+	log := updater.log.WithField("pid", process.PID)
+
+	if policy.ShutdownHook != nil {
+		log.Debug("Preparing target for shutdown")
+		ctx, cancel := context.WithTimeout(
+			context.Background(),
+			policy.ShutdownHookTimeout)
+		err := policy.ShutdownHook.PrepareShutdown(ctx, process)
+		cancel()
+		if err != nil {
+			log.Warningf("Unable to prepare target for shutdown: %s", err)
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"signal":       policy.Signal,
+		"grace_period": policy.GracePeriod,
+	}).Info("Signalling target to stop")
+	err := signalTarget(cmd.Process, policy.Signal)
+	if err != nil {
+		log.Warningf("Target could not be signalled: %s", err)
+		return false
+	}
+
+	timer := time.NewTimer(policy.GracePeriod)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		return true
+	case <-timer.C:
+		log.Warning("Target did not stop in the grace period")
+		return false
+	}
+}
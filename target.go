@@ -15,7 +15,20 @@ package unattended
 
 import (
 	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/ProjectLimitless/go-unattended/tuf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tempDirectoryName is the directory in VersionsPath used for downloads
+	tempDirectoryName = "tmp"
+	// stateDirectoryName is the directory in VersionsPath used to persist
+	// the state of Unattended
+	stateDirectoryName = ".unattended"
 )
 
 // Target defines the target application to be controlled and updated by
@@ -28,6 +41,9 @@ type Target struct {
 	// UpdateChannel defines the update channel, can be 'stable', 'beta' or any
 	// other value defined by the Unattended server
 	UpdateChannel string
+	// InstallSource is sent as the cause of the requests to the server, for
+	// example 'scheduler' or 'ondemand'. Not sent if empty
+	InstallSource string
 	// VersionsPath is the base path to where the versioned directories were
 	// installed to
 	VersionsPath string
@@ -35,28 +51,188 @@ type Target struct {
 	ApplicationName string
 	// ApplicationParameters to use in executing the target
 	ApplicationParameters []string
+	// ExtractionLimits limits the size of extracted packages, unset limits
+	// use the defaults
+	ExtractionLimits ExtractionLimits
+	// IgnorePackagePermissions ignores the permissions of the files in
+	// packages. Directories and executable files are extracted with 0755 and
+	// other files with 0644
+	IgnorePackagePermissions bool
+	// PreservePackageOwnership applies the owner, the setuid and setgid bits
+	// and the extended attributes of the files in packages when running as
+	// root. By default extracted files are owned by the user running
+	// Unattended and never setuid or setgid
+	PreservePackageOwnership bool
+	// ExtractionHeadroom is the free disk space required for extracting a
+	// package as a multiple of the package size, defaults to
+	// DefaultExtractionHeadroom. The free space is checked before the
+	// package is downloaded
+	ExtractionHeadroom float64
+	// DownloadRetries is the number of times a download failing with a
+	// transient error is retried, defaults to DefaultDownloadRetries. Set
+	// to -1 to disable retries
+	DownloadRetries int
+	// DownloadBackoff is the delay before the first download retry, doubling
+	// with every retry. Defaults to DefaultDownloadBackoff
+	DownloadBackoff time.Duration
+	// BandwidthLimit caps the rate of package downloads
+	BandwidthLimit BandwidthLimit
+	// DownloadWindows are the daily windows packages are downloaded in.
+	// Outside of the windows updates are still checked for, but downloads
+	// are postponed and running downloads are paused. If not set packages
+	// are downloaded at any time
+	DownloadWindows []TimeWindow
+	// AppAttributes adds custom attributes to the target and its components
+	// in the requests to the server
+	AppAttributes AppAttributes
+	// Components are companions of the target, such as plugins, data
+	// bundles or models, checked for updates in the same request as the
+	// target
+	Components []Component
+	// Extractors adds or replaces the extractors of package types, for
+	// example PackageTypeZip
+	Extractors map[string]Extractor
+	// Keyring of the keys trusted to sign packages. If set, packages must be
+	// signed by one of the keys, either with the signature in the manifest
+	// or with a detached '.sig' file next to the package
+	Keyring *Keyring
+	// ResponseKeyring of the keys trusted to sign update responses. If set,
+	// responses must carry a signature of the body in the
+	// ResponseSignatureHeader, echo the request ID and not be expired
+	ResponseKeyring *Keyring
+	// TUF verifies packages against the targets metadata of a repository
+	// modelled on The Update Framework instead of the manifest's hash. The
+	// trusted metadata is kept in VersionsPath
+	TUF *tuf.Config
+	// VersionScheme parses and orders the installed versions, defaults to
+	// FourPartVersionScheme if not set
+	VersionScheme VersionScheme
+	// ProbationPeriod is the time a newly updated version must keep running
+	// before the update is considered successful, defaults to
+	// DefaultProbationPeriod. Versions failing probation are rolled back
+	ProbationPeriod time.Duration
+	// HealthCheck determines if the running target is healthy. If not set the
+	// target is healthy once started
+	HealthCheck HealthCheck
+	// HealthCheckInterval between health checks, defaults to
+	// DefaultHealthCheckInterval
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout of a single health check, defaults to
+	// DefaultHealthCheckTimeout
+	HealthCheckTimeout time.Duration
+	// HealthCheckThreshold is the number of consecutive failed health checks
+	// before the target is unhealthy, defaults to DefaultHealthCheckThreshold.
+	// Unhealthy targets are rolled back during probation and restarted after
+	HealthCheckThreshold int
+	// StopPolicy defines how the target is stopped gracefully before it is
+	// killed
+	StopPolicy StopPolicy
+	// NewSession starts the target in a new session instead of only a new
+	// process group. Only used on Unix
+	NewSession bool
+	// KillWithSupervisor kills the target if Unattended itself dies, using
+	// PR_SET_PDEATHSIG. The target is started on an OS thread locked for its
+	// lifetime. Only used on Linux
+	KillWithSupervisor bool
+
+	log *logrus.Entry
 }
 
 // LatestVersion returns the latest version installed of the target
 func (target *Target) LatestVersion() string {
-	// ReadDir lists the directories sorted, the last one will be
-	// the latest version
-	files, err := ioutil.ReadDir(target.VersionsPath)
+	return latestInstalledVersion(
+		target.VersionsPath,
+		target.versionScheme(),
+		target.badVersions(),
+		nil,
+		target.logger())
+}
+
+// latestInstalledVersion returns the latest version directory in the
+// versions path, skipping bad versions and, if set, versions not older than
+// before. The initial version of the scheme is returned if no versions are
+// installed
+func latestInstalledVersion(
+	versionsPath string,
+	scheme VersionScheme,
+	badVersions map[string]bool,
+	before Version,
+	log *logrus.Entry) string {
+
+	var latestVersion Version
+	for _, version := range installedVersions(versionsPath, scheme, log) {
+		if badVersions[version.String()] {
+			continue
+		}
+		if before != nil && version.Compare(before) >= 0 {
+			continue
+		}
+		// Versions with equal precedence are ordered by name to always
+		// select the same directory
+		if latestVersion == nil ||
+			version.Compare(latestVersion) > 0 ||
+			(version.Compare(latestVersion) == 0 && version.String() > latestVersion.String()) {
+			latestVersion = version
+		}
+	}
+	if latestVersion == nil {
+		return scheme.Initial()
+	}
+	return latestVersion.String()
+}
+
+// installedVersions returns the versions of the version directories in the
+// versions path
+func installedVersions(versionsPath string, scheme VersionScheme, log *logrus.Entry) []Version {
+	files, err := ioutil.ReadDir(versionsPath)
 	if err != nil {
-		return "0.0.0.0"
+		return nil
 	}
 
-	latestVersion := "0.0.0.0"
+	var versions []Version
 	for _, f := range files {
-		// Skip all dirs not containing a '.'
-		if strings.Contains(f.Name(), ".") == false {
-			continue
-		}
 		// Skip any files
 		if f.IsDir() == false {
 			continue
 		}
-		latestVersion = f.Name()
+		// Skip the temp directory and any hidden directories
+		if f.Name() == tempDirectoryName || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		version, err := scheme.Parse(f.Name())
+		if err != nil {
+			log.WithField(
+				"path", f.Name(),
+			).Warningf("Skipping version directory: %s", err)
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// versionScheme returns the configured version scheme or the default
+func (target *Target) versionScheme() VersionScheme {
+	if target.VersionScheme == nil {
+		return FourPartVersionScheme{}
+	}
+	return target.VersionScheme
+}
+
+// statePath returns the path of the named state file in VersionsPath
+func (target *Target) statePath(name string) string {
+	return statePath(target.VersionsPath, name)
+}
+
+// statePath returns the path of the named state file in the versions path
+func statePath(versionsPath string, name string) string {
+	return filepath.Join(versionsPath, stateDirectoryName, name)
+}
+
+// logger returns the log entry set by Unattended or the standard logger
+func (target *Target) logger() *logrus.Entry {
+	if target.log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
 	}
-	return latestVersion
+	return target.log
 }
@@ -0,0 +1,479 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package tuf
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxMetadataSize is the maximum size in bytes of a metadata file
+	MaxMetadataSize = 16 << 20
+
+	rootFileName      = "root.json"
+	timestampFileName = "timestamp.json"
+	snapshotFileName  = "snapshot.json"
+	targetsFileName   = "targets.json"
+)
+
+// errNotFound is returned by fetch when the repository has no such file
+var errNotFound = errors.New("Metadata file not found")
+
+// Config of the repository
+type Config struct {
+	// RepositoryURL is the base URL of the metadata files
+	RepositoryURL string
+	// Root is the initial trusted root metadata, usually shipped with the
+	// application. It is only used until newer root metadata is persisted
+	Root []byte
+}
+
+// Client keeps the trusted metadata of the repository up to date and looks
+// up target files. Trusted metadata is persisted in the local path
+type Client struct {
+	config    Config
+	path      string
+	root      *Root
+	timestamp *Timestamp
+	snapshot  *Snapshot
+	targets   *Targets
+}
+
+// NewClient loads the trusted metadata from the local path, or starts from
+// the initial root metadata of the config
+func NewClient(config Config, path string) (*Client, error) {
+	client := &Client{
+		config: config,
+		path:   path,
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(path, rootFileName))
+	if os.IsNotExist(err) {
+		content = config.Root
+	} else if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return nil, fmt.Errorf("No trusted root metadata")
+	}
+	root := &Root{}
+	signed, err := decodeSigned(content, RoleRoot, root)
+	if err != nil {
+		return nil, err
+	}
+	err = root.verifySignatures(RoleRoot, signed)
+	if err != nil {
+		return nil, err
+	}
+	client.root = root
+
+	// Metadata that no longer verifies, for example after keys were
+	// rotated, is fetched again on the next update
+	timestamp := &Timestamp{}
+	if client.loadTrusted(timestampFileName, RoleTimestamp, timestamp) {
+		client.timestamp = timestamp
+	}
+	snapshot := &Snapshot{}
+	if client.loadTrusted(snapshotFileName, RoleSnapshot, snapshot) {
+		client.snapshot = snapshot
+	}
+	targets := &Targets{}
+	if client.loadTrusted(targetsFileName, RoleTargets, targets) {
+		client.targets = targets
+	}
+	return client, nil
+}
+
+// Update fetches the metadata of the repository in the order root,
+// timestamp, snapshot and targets, verifying each against the trusted
+// metadata before it is trusted itself
+func (client *Client) Update(ctx context.Context) error {
+	now := time.Now()
+
+	err := client.updateRoot(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkExpiry(RoleRoot, client.root.Common, now)
+	if err != nil {
+		return err
+	}
+
+	err = client.updateTimestamp(ctx, now)
+	if err != nil {
+		return err
+	}
+	err = client.updateSnapshot(ctx, now)
+	if err != nil {
+		return err
+	}
+	return client.updateTargets(ctx, now)
+}
+
+// Target returns the description of the target file from the trusted
+// targets metadata
+func (client *Client) Target(name string) (TargetFile, error) {
+	if client.targets == nil {
+		return TargetFile{}, fmt.Errorf("No trusted targets metadata")
+	}
+	target, ok := client.targets.Targets[name]
+	if ok == false {
+		return TargetFile{}, &MetadataError{
+			Role:   RoleTargets,
+			Reason: ErrUnknownTarget,
+			Detail: name,
+		}
+	}
+	return target, nil
+}
+
+// Verify checks the content matches the length and all supported hashes of
+// the target file. At least one supported hash is required
+func (target TargetFile) Verify(reader io.Reader) error {
+	hashers := make(map[string]hash.Hash)
+	for algorithm := range target.Hashes {
+		switch algorithm {
+		case "sha256":
+			hashers[algorithm] = sha256.New()
+		case "sha512":
+			hashers[algorithm] = sha512.New()
+		}
+	}
+	if len(hashers) == 0 {
+		return fmt.Errorf("Target has no supported hashes")
+	}
+
+	writers := make([]io.Writer, 0, len(hashers))
+	for _, hasher := range hashers {
+		writers = append(writers, hasher)
+	}
+	// Never read more than one byte past the expected length
+	length, err := io.Copy(
+		io.MultiWriter(writers...),
+		io.LimitReader(reader, target.Length+1))
+	if err != nil {
+		return err
+	}
+	if length != target.Length {
+		return fmt.Errorf("Target length is %d, expected %d", length, target.Length)
+	}
+	for algorithm, hasher := range hashers {
+		if strings.EqualFold(hex.EncodeToString(hasher.Sum(nil)), target.Hashes[algorithm]) == false {
+			return fmt.Errorf("Target %s hash does not match", algorithm)
+		}
+	}
+	return nil
+}
+
+// updateRoot follows the chain of root metadata versions. Every new root
+// must be signed by the threshold of the trusted root and of itself
+func (client *Client) updateRoot(ctx context.Context) error {
+	for {
+		version := client.root.Version + 1
+		content, err := client.fetch(ctx, fmt.Sprintf("%d.%s", version, rootFileName))
+		if err == errNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		root := &Root{}
+		signed, err := decodeSigned(content, RoleRoot, root)
+		if err != nil {
+			return err
+		}
+		err = client.root.verifySignatures(RoleRoot, signed)
+		if err != nil {
+			return err
+		}
+		err = root.verifySignatures(RoleRoot, signed)
+		if err != nil {
+			return err
+		}
+		if root.Version != version {
+			return &MetadataError{
+				Role:   RoleRoot,
+				Reason: ErrVersionMismatch,
+				Detail: fmt.Sprintf("version %d, expected %d", root.Version, version),
+			}
+		}
+
+		err = client.persist(rootFileName, content)
+		if err != nil {
+			return err
+		}
+		// Metadata signed with rotated keys can never be verified again, it
+		// is replaced on this update
+		if sameKeys(client.root, root, RoleTimestamp) == false ||
+			sameKeys(client.root, root, RoleSnapshot) == false {
+			client.forget(timestampFileName)
+			client.forget(snapshotFileName)
+			client.timestamp = nil
+			client.snapshot = nil
+		}
+		if sameKeys(client.root, root, RoleTargets) == false {
+			client.forget(targetsFileName)
+			client.targets = nil
+		}
+		client.root = root
+	}
+}
+
+// updateTimestamp fetches the timestamp metadata
+func (client *Client) updateTimestamp(ctx context.Context, now time.Time) error {
+	content, err := client.fetch(ctx, timestampFileName)
+	if err != nil {
+		return err
+	}
+	timestamp := &Timestamp{}
+	signed, err := decodeSigned(content, RoleTimestamp, timestamp)
+	if err != nil {
+		return err
+	}
+	err = client.root.verifySignatures(RoleTimestamp, signed)
+	if err != nil {
+		return err
+	}
+	if client.timestamp != nil {
+		err = checkRollback(RoleTimestamp, timestamp.Version, client.timestamp.Version)
+		if err != nil {
+			return err
+		}
+		err = checkRollback(
+			RoleSnapshot,
+			timestamp.Meta[snapshotFileName].Version,
+			client.timestamp.Meta[snapshotFileName].Version)
+		if err != nil {
+			return err
+		}
+	}
+	err = checkExpiry(RoleTimestamp, timestamp.Common, now)
+	if err != nil {
+		return err
+	}
+
+	err = client.persist(timestampFileName, content)
+	if err != nil {
+		return err
+	}
+	client.timestamp = timestamp
+	return nil
+}
+
+// updateSnapshot fetches the snapshot metadata listed by the timestamp
+func (client *Client) updateSnapshot(ctx context.Context, now time.Time) error {
+	content, err := client.fetch(ctx, snapshotFileName)
+	if err != nil {
+		return err
+	}
+	snapshot := &Snapshot{}
+	signed, err := decodeSigned(content, RoleSnapshot, snapshot)
+	if err != nil {
+		return err
+	}
+	err = client.root.verifySignatures(RoleSnapshot, signed)
+	if err != nil {
+		return err
+	}
+	err = checkVersion(
+		RoleSnapshot,
+		snapshot.Version,
+		client.timestamp.Meta[snapshotFileName].Version)
+	if err != nil {
+		return err
+	}
+	if client.snapshot != nil {
+		for name, trusted := range client.snapshot.Meta {
+			err = checkRollback(name, snapshot.Meta[name].Version, trusted.Version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = checkExpiry(RoleSnapshot, snapshot.Common, now)
+	if err != nil {
+		return err
+	}
+
+	err = client.persist(snapshotFileName, content)
+	if err != nil {
+		return err
+	}
+	client.snapshot = snapshot
+	return nil
+}
+
+// updateTargets fetches the targets metadata listed by the snapshot
+func (client *Client) updateTargets(ctx context.Context, now time.Time) error {
+	content, err := client.fetch(ctx, targetsFileName)
+	if err != nil {
+		return err
+	}
+	targets := &Targets{}
+	signed, err := decodeSigned(content, RoleTargets, targets)
+	if err != nil {
+		return err
+	}
+	err = client.root.verifySignatures(RoleTargets, signed)
+	if err != nil {
+		return err
+	}
+	err = checkVersion(
+		RoleTargets,
+		targets.Version,
+		client.snapshot.Meta[targetsFileName].Version)
+	if err != nil {
+		return err
+	}
+	err = checkExpiry(RoleTargets, targets.Common, now)
+	if err != nil {
+		return err
+	}
+
+	err = client.persist(targetsFileName, content)
+	if err != nil {
+		return err
+	}
+	client.targets = targets
+	return nil
+}
+
+// fetch downloads a metadata file from the repository
+func (client *Client) fetch(ctx context.Context, name string) ([]byte, error) {
+	request, err := http.NewRequest(
+		http.MethodGet,
+		strings.TrimSuffix(client.config.RepositoryURL, "/")+"/"+name,
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch %s: %s", name, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"Unable to fetch %s, received HTTP status code %d",
+			name,
+			response.StatusCode)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, MaxMetadataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch %s: %s", name, err)
+	}
+	if len(content) > MaxMetadataSize {
+		return nil, fmt.Errorf("Unable to fetch %s, larger than %d bytes", name, MaxMetadataSize)
+	}
+	return content, nil
+}
+
+// loadTrusted loads persisted metadata and returns true if it is still
+// signed by the keys of the trusted root
+func (client *Client) loadTrusted(fileName string, roleName string, value interface{}) bool {
+	content, err := ioutil.ReadFile(filepath.Join(client.path, fileName))
+	if err != nil {
+		return false
+	}
+	signed, err := decodeSigned(content, roleName, value)
+	if err != nil {
+		return false
+	}
+	return client.root.verifySignatures(roleName, signed) == nil
+}
+
+// persist writes the metadata file to the local path, replacing the file
+// atomically
+func (client *Client) persist(fileName string, content []byte) error {
+	err := os.MkdirAll(client.path, 0755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(client.path, fileName)
+	temporaryPath := path + ".tmp"
+	err = ioutil.WriteFile(temporaryPath, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporaryPath, path)
+}
+
+// forget removes the persisted metadata file
+func (client *Client) forget(fileName string) {
+	os.Remove(filepath.Join(client.path, fileName))
+}
+
+// checkVersion returns ErrVersionMismatch if the version differs from the
+// version listed by the referring metadata
+func checkVersion(roleName string, version int64, expected int64) error {
+	if version != expected {
+		return &MetadataError{
+			Role:   roleName,
+			Reason: ErrVersionMismatch,
+			Detail: fmt.Sprintf("version %d, expected %d", version, expected),
+		}
+	}
+	return nil
+}
+
+// checkRollback returns ErrRollback if the version is lower than the trusted
+// version
+func checkRollback(roleName string, version int64, trusted int64) error {
+	if version < trusted {
+		return &MetadataError{
+			Role:   roleName,
+			Reason: ErrRollback,
+			Detail: fmt.Sprintf("version %d, trusted %d", version, trusted),
+		}
+	}
+	return nil
+}
+
+// sameKeys returns true if the role has the same keys and threshold in both
+// root metadata
+func sameKeys(trusted *Root, root *Root, roleName string) bool {
+	trustedRole := trusted.Roles[roleName]
+	role := root.Roles[roleName]
+	if trustedRole.Threshold != role.Threshold || len(trustedRole.KeyIDs) != len(role.KeyIDs) {
+		return false
+	}
+	keyIDs := make(map[string]bool)
+	for _, keyID := range trustedRole.KeyIDs {
+		keyIDs[keyID] = true
+	}
+	for _, keyID := range role.KeyIDs {
+		if keyIDs[keyID] == false {
+			return false
+		}
+	}
+	return true
+}
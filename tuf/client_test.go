@@ -0,0 +1,542 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package tuf
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKey is a key pair used to sign test metadata
+type testKey struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+// newTestKey generates an Ed25519 key pair
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{public: public, private: private}
+}
+
+// metadata returns the key as listed in the root metadata
+func (key testKey) metadata() Key {
+	return Key{
+		Type:  KeyTypeEd25519,
+		Value: KeyValue{Public: hex.EncodeToString(key.public)},
+	}
+}
+
+// id returns the ID of the key
+func (key testKey) id() string {
+	return key.metadata().ID()
+}
+
+// signMetadata returns the metadata file of the value signed by the keys
+func signMetadata(t *testing.T, value interface{}, keys ...testKey) []byte {
+	t.Helper()
+	content, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := Signed{Signed: content}
+	for _, key := range keys {
+		signed.Signatures = append(signed.Signatures, Signature{
+			KeyID:     key.id(),
+			Signature: hex.EncodeToString(ed25519.Sign(key.private, content)),
+		})
+	}
+	file, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// testRelease describes the timestamp, snapshot and targets metadata
+// published by a test repository
+type testRelease struct {
+	timestamp int64
+	snapshot  int64
+	targets   int64
+	// listedSnapshot and listedTargets are the versions listed by the
+	// referring metadata, defaulting to the published versions
+	listedSnapshot int64
+	listedTargets  int64
+	// expired is the role published with expired metadata
+	expired string
+	// signedBy signs the timestamp metadata instead of its key
+	signedBy *testKey
+}
+
+// testRepository serves the metadata of a TUF repository
+type testRepository struct {
+	mutex    sync.Mutex
+	files    map[string][]byte
+	server   *httptest.Server
+	path     string
+	rootKeys []testKey
+	keys     map[string]testKey
+	root     []byte
+}
+
+// newTestRepository creates a repository with a key for every role and
+// publishes the first version of all metadata
+func newTestRepository(t *testing.T) *testRepository {
+	t.Helper()
+	repository := &testRepository{
+		files:    make(map[string][]byte),
+		path:     t.TempDir(),
+		rootKeys: []testKey{newTestKey(t)},
+		keys: map[string]testKey{
+			RoleTimestamp: newTestKey(t),
+			RoleSnapshot:  newTestKey(t),
+			RoleTargets:   newTestKey(t),
+		},
+	}
+	repository.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			repository.mutex.Lock()
+			content, ok := repository.files[strings.TrimPrefix(r.URL.Path, "/")]
+			repository.mutex.Unlock()
+			if ok == false {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(content)
+		}))
+	t.Cleanup(repository.server.Close)
+
+	repository.root = signMetadata(
+		t,
+		repository.newRoot(1, repository.rootKeys, time.Now().Add(time.Hour)),
+		repository.rootKeys...)
+	repository.publish(t, testRelease{timestamp: 1, snapshot: 1, targets: 1})
+	return repository
+}
+
+// newRoot returns root metadata trusting the root keys and the keys of the
+// repository for the other roles
+func (repository *testRepository) newRoot(version int64, rootKeys []testKey, expires time.Time) *Root {
+	root := &Root{
+		Common: Common{Type: RoleRoot, Version: version, Expires: expires},
+		Keys:   make(map[string]Key),
+		Roles:  make(map[string]Role),
+	}
+	rootRole := Role{Threshold: len(rootKeys)}
+	for _, key := range rootKeys {
+		root.Keys[key.id()] = key.metadata()
+		rootRole.KeyIDs = append(rootRole.KeyIDs, key.id())
+	}
+	root.Roles[RoleRoot] = rootRole
+	for roleName, key := range repository.keys {
+		root.Keys[key.id()] = key.metadata()
+		root.Roles[roleName] = Role{KeyIDs: []string{key.id()}, Threshold: 1}
+	}
+	return root
+}
+
+// set serves the content as the metadata file
+func (repository *testRepository) set(name string, content []byte) {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+	repository.files[name] = content
+}
+
+// publish signs and serves the timestamp, snapshot and targets metadata of
+// the release
+func (repository *testRepository) publish(t *testing.T, release testRelease) {
+	t.Helper()
+	if release.listedSnapshot == 0 {
+		release.listedSnapshot = release.snapshot
+	}
+	if release.listedTargets == 0 {
+		release.listedTargets = release.targets
+	}
+	expires := func(roleName string) time.Time {
+		if release.expired == roleName {
+			return time.Now().Add(-time.Hour)
+		}
+		return time.Now().Add(time.Hour)
+	}
+
+	timestampKey := repository.keys[RoleTimestamp]
+	if release.signedBy != nil {
+		timestampKey = *release.signedBy
+	}
+	repository.set(timestampFileName, signMetadata(t, Timestamp{
+		Common: Common{Type: RoleTimestamp, Version: release.timestamp, Expires: expires(RoleTimestamp)},
+		Meta:   map[string]MetaFile{snapshotFileName: {Version: release.listedSnapshot}},
+	}, timestampKey))
+	repository.set(snapshotFileName, signMetadata(t, Snapshot{
+		Common: Common{Type: RoleSnapshot, Version: release.snapshot, Expires: expires(RoleSnapshot)},
+		Meta:   map[string]MetaFile{targetsFileName: {Version: release.listedTargets}},
+	}, repository.keys[RoleSnapshot]))
+	repository.set(targetsFileName, signMetadata(t, Targets{
+		Common: Common{Type: RoleTargets, Version: release.targets, Expires: expires(RoleTargets)},
+		Targets: map[string]TargetFile{
+			"package.tar.gz": {Length: 7, Hashes: map[string]string{"sha256": "00"}},
+		},
+	}, repository.keys[RoleTargets]))
+}
+
+// client returns a client persisting the trusted metadata in the path of
+// the repository
+func (repository *testRepository) client(t *testing.T) *Client {
+	t.Helper()
+	client, err := NewClient(Config{
+		RepositoryURL: repository.server.URL,
+		Root:          repository.root,
+	}, repository.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestVerifySignaturesThreshold(t *testing.T) {
+	keys := []testKey{newTestKey(t), newTestKey(t), newTestKey(t)}
+	outsider := newTestKey(t)
+	root := &Root{
+		Keys:  map[string]Key{outsider.id(): outsider.metadata()},
+		Roles: map[string]Role{RoleTargets: {Threshold: 2}},
+	}
+	role := root.Roles[RoleTargets]
+	for _, key := range keys {
+		root.Keys[key.id()] = key.metadata()
+		role.KeyIDs = append(role.KeyIDs, key.id())
+	}
+	root.Roles[RoleTargets] = role
+
+	value := Common{Type: RoleTargets, Version: 1}
+	tests := []struct {
+		name   string
+		signed func() Signed
+		reason error
+	}{
+		{
+			name: "threshold of keys",
+			signed: func() Signed {
+				return decodeTestSigned(t, signMetadata(t, value, keys[0], keys[1]))
+			},
+		},
+		{
+			name: "all keys",
+			signed: func() Signed {
+				return decodeTestSigned(t, signMetadata(t, value, keys...))
+			},
+		},
+		{
+			name: "below threshold",
+			signed: func() Signed {
+				return decodeTestSigned(t, signMetadata(t, value, keys[0]))
+			},
+			reason: ErrThreshold,
+		},
+		{
+			name: "same key twice",
+			signed: func() Signed {
+				return decodeTestSigned(t, signMetadata(t, value, keys[0], keys[0]))
+			},
+			reason: ErrThreshold,
+		},
+		{
+			name: "key of another role",
+			signed: func() Signed {
+				return decodeTestSigned(t, signMetadata(t, value, keys[0], outsider))
+			},
+			reason: ErrThreshold,
+		},
+		{
+			name: "invalid signature",
+			signed: func() Signed {
+				signed := decodeTestSigned(t, signMetadata(t, value, keys[0], keys[1]))
+				signed.Signatures[1].Signature = signed.Signatures[0].Signature
+				return signed
+			},
+			reason: ErrThreshold,
+		},
+		{
+			name: "signature of other content",
+			signed: func() Signed {
+				signed := decodeTestSigned(t, signMetadata(t, value, keys[0], keys[1]))
+				signed.Signed = []byte(`{"_type":"targets","version":2}`)
+				return signed
+			},
+			reason: ErrThreshold,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := root.verifySignatures(RoleTargets, test.signed())
+			if test.reason == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				return
+			}
+			if errors.Is(err, test.reason) == false {
+				t.Fatalf("Expected %s, got %v", test.reason, err)
+			}
+		})
+	}
+}
+
+// decodeTestSigned parses a metadata file
+func decodeTestSigned(t *testing.T, content []byte) Signed {
+	t.Helper()
+	var signed Signed
+	err := json.Unmarshal(content, &signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestClientUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		release testRelease
+		// stale serves the metadata file of the trusted release
+		stale  string
+		reason error
+	}{
+		{
+			name:    "newer release",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 3},
+		},
+		{
+			name:    "unchanged targets",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 2},
+		},
+		{
+			name:    "timestamp rollback",
+			release: testRelease{timestamp: 1, snapshot: 2, targets: 2},
+			reason:  ErrRollback,
+		},
+		{
+			name:    "snapshot rollback",
+			release: testRelease{timestamp: 3, snapshot: 1, targets: 2},
+			reason:  ErrRollback,
+		},
+		{
+			name:    "targets rollback",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 1},
+			reason:  ErrRollback,
+		},
+		{
+			name:    "snapshot not listed by the timestamp",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 3},
+			stale:   snapshotFileName,
+			reason:  ErrVersionMismatch,
+		},
+		{
+			name:    "targets not listed by the snapshot",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 3},
+			stale:   targetsFileName,
+			reason:  ErrVersionMismatch,
+		},
+		{
+			name:    "newer targets than listed",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 4, listedTargets: 3},
+			reason:  ErrVersionMismatch,
+		},
+		{
+			name:    "expired timestamp",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 3, expired: RoleTimestamp},
+			reason:  ErrExpired,
+		},
+		{
+			name:    "expired snapshot",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 3, expired: RoleSnapshot},
+			reason:  ErrExpired,
+		},
+		{
+			name:    "expired targets",
+			release: testRelease{timestamp: 3, snapshot: 3, targets: 3, expired: RoleTargets},
+			reason:  ErrExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := newTestRepository(t)
+			repository.publish(t, testRelease{timestamp: 2, snapshot: 2, targets: 2})
+			client := repository.client(t)
+			err := client.Update(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			repository.mutex.Lock()
+			stale := repository.files[test.stale]
+			repository.mutex.Unlock()
+			repository.publish(t, test.release)
+			if test.stale != "" {
+				repository.set(test.stale, stale)
+			}
+
+			err = client.Update(context.Background())
+			if test.reason == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				if client.targets.Version != test.release.targets {
+					t.Fatalf("Expected targets version %d, got %d", test.release.targets, client.targets.Version)
+				}
+				return
+			}
+			if errors.Is(err, test.reason) == false {
+				t.Fatalf("Expected %s, got %v", test.reason, err)
+			}
+			if client.targets.Version != 2 {
+				t.Fatalf("Expected the trusted targets version 2, got %d", client.targets.Version)
+			}
+		})
+	}
+}
+
+func TestClientUpdatePersistsTrustedVersions(t *testing.T) {
+	repository := newTestRepository(t)
+	repository.publish(t, testRelease{timestamp: 2, snapshot: 2, targets: 2})
+	err := repository.client(t).Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new client must not accept older metadata after a restart
+	repository.publish(t, testRelease{timestamp: 1, snapshot: 1, targets: 1})
+	err = repository.client(t).Update(context.Background())
+	if errors.Is(err, ErrRollback) == false {
+		t.Fatalf("Expected %s, got %v", ErrRollback, err)
+	}
+}
+
+func TestClientUpdateRoot(t *testing.T) {
+	tests := []struct {
+		name string
+		// root returns the metadata served as 2.root.json
+		root   func(t *testing.T, repository *testRepository, newKey testKey) []byte
+		reason error
+	}{
+		{
+			name: "rotated root key",
+			root: func(t *testing.T, repository *testRepository, newKey testKey) []byte {
+				root := repository.newRoot(2, []testKey{newKey}, time.Now().Add(time.Hour))
+				return signMetadata(t, root, repository.rootKeys[0], newKey)
+			},
+		},
+		{
+			name: "not signed by the trusted root",
+			root: func(t *testing.T, repository *testRepository, newKey testKey) []byte {
+				root := repository.newRoot(2, []testKey{newKey}, time.Now().Add(time.Hour))
+				return signMetadata(t, root, newKey)
+			},
+			reason: ErrThreshold,
+		},
+		{
+			name: "not signed by the new root",
+			root: func(t *testing.T, repository *testRepository, newKey testKey) []byte {
+				root := repository.newRoot(2, []testKey{newKey}, time.Now().Add(time.Hour))
+				return signMetadata(t, root, repository.rootKeys[0])
+			},
+			reason: ErrThreshold,
+		},
+		{
+			name: "skipped version",
+			root: func(t *testing.T, repository *testRepository, newKey testKey) []byte {
+				root := repository.newRoot(3, repository.rootKeys, time.Now().Add(time.Hour))
+				return signMetadata(t, root, repository.rootKeys...)
+			},
+			reason: ErrVersionMismatch,
+		},
+		{
+			name: "expired root",
+			root: func(t *testing.T, repository *testRepository, newKey testKey) []byte {
+				root := repository.newRoot(2, repository.rootKeys, time.Now().Add(-time.Hour))
+				return signMetadata(t, root, repository.rootKeys...)
+			},
+			reason: ErrExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := newTestRepository(t)
+			client := repository.client(t)
+			repository.set("2."+rootFileName, test.root(t, repository, newTestKey(t)))
+
+			err := client.Update(context.Background())
+			if test.reason == nil {
+				if err != nil {
+					t.Fatalf("Expected no error, got %s", err)
+				}
+				if client.root.Version != 2 {
+					t.Fatalf("Expected root version 2, got %d", client.root.Version)
+				}
+				return
+			}
+			if errors.Is(err, test.reason) == false {
+				t.Fatalf("Expected %s, got %v", test.reason, err)
+			}
+		})
+	}
+}
+
+func TestClientUpdateRejectsUntrustedTimestamp(t *testing.T) {
+	repository := newTestRepository(t)
+	client := repository.client(t)
+	outsider := newTestKey(t)
+	repository.publish(t, testRelease{timestamp: 2, snapshot: 2, targets: 2, signedBy: &outsider})
+
+	err := client.Update(context.Background())
+	if errors.Is(err, ErrThreshold) == false {
+		t.Fatalf("Expected %s, got %v", ErrThreshold, err)
+	}
+}
+
+func TestClientTarget(t *testing.T) {
+	repository := newTestRepository(t)
+	client := repository.client(t)
+	err := client.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := client.Target("package.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Length != 7 {
+		t.Fatalf("Expected length 7, got %d", target.Length)
+	}
+	_, err = client.Target("other.tar.gz")
+	if errors.Is(err, ErrUnknownTarget) == false {
+		t.Fatalf("Expected %s, got %v", ErrUnknownTarget, err)
+	}
+}
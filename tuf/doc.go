@@ -0,0 +1,3 @@
+// Package tuf implements client side verification of update repository
+// metadata modelled on The Update Framework https://theupdateframework.io
+package tuf
@@ -0,0 +1,268 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package tuf
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// RoleRoot is the role that delegates trust to the keys of all roles
+	RoleRoot = "root"
+	// RoleTargets is the role that lists the target files
+	RoleTargets = "targets"
+	// RoleSnapshot is the role that lists the version of the targets metadata
+	RoleSnapshot = "snapshot"
+	// RoleTimestamp is the role that lists the version of the snapshot
+	// metadata and is refreshed frequently
+	RoleTimestamp = "timestamp"
+
+	// KeyTypeEd25519 is the only supported key type
+	KeyTypeEd25519 = "ed25519"
+)
+
+var (
+	// ErrExpired is returned when trusted metadata has expired, protecting
+	// against freeze attacks
+	ErrExpired = errors.New("Metadata has expired")
+	// ErrRollback is returned when metadata has a lower version than the
+	// trusted metadata
+	ErrRollback = errors.New("Metadata version is lower than the trusted version")
+	// ErrVersionMismatch is returned when metadata has a different version
+	// than listed by the metadata referring to it, protecting against
+	// mix-and-match attacks
+	ErrVersionMismatch = errors.New("Metadata version does not match the referring metadata")
+	// ErrThreshold is returned when metadata is not signed by enough keys of
+	// its role
+	ErrThreshold = errors.New("Metadata is not signed by the threshold of keys")
+	// ErrUnknownTarget is returned when a target is not listed in the
+	// targets metadata
+	ErrUnknownTarget = errors.New("Target is not listed in the targets metadata")
+)
+
+// MetadataError is returned when metadata of a role is rejected. Reason is
+// one of the Err* reasons
+type MetadataError struct {
+	// Role of the rejected metadata
+	Role string
+	// Reason the metadata was rejected
+	Reason error
+	// Detail about the rejection
+	Detail string
+}
+
+// Error returns the description of the rejection
+func (err *MetadataError) Error() string {
+	return fmt.Sprintf("Rejected %s metadata: %s: %s", err.Role, err.Reason, err.Detail)
+}
+
+// Unwrap returns the reason, allowing errors.Is(err, ErrRollback)
+func (err *MetadataError) Unwrap() error {
+	return err.Reason
+}
+
+// Signed is a metadata file. The signatures are made over the exact bytes
+// of the signed value as it appears in the file
+type Signed struct {
+	// Signed is the role specific metadata
+	Signed json.RawMessage `json:"signed"`
+	// Signatures of the signed value
+	Signatures []Signature `json:"signatures"`
+}
+
+// Signature of metadata
+type Signature struct {
+	// KeyID of the key that made the signature
+	KeyID string `json:"keyid"`
+	// Signature is the hex encoded signature
+	Signature string `json:"sig"`
+}
+
+// Key is a public key trusted by the root role
+type Key struct {
+	// Type of the key, only ed25519 is supported
+	Type string `json:"keytype"`
+	// Value of the key
+	Value KeyValue `json:"keyval"`
+}
+
+// KeyValue holds the public part of a key
+type KeyValue struct {
+	// Public is the hex encoded public key
+	Public string `json:"public"`
+}
+
+// ID returns the ID of the key, the hex encoded SHA-256 digest of the
+// public key
+func (key Key) ID() string {
+	public, err := hex.DecodeString(key.Value.Public)
+	if err != nil {
+		return ""
+	}
+	digest := sha256.Sum256(public)
+	return hex.EncodeToString(digest[:])
+}
+
+// Role lists the keys allowed to sign the metadata of a role and the number
+// of signatures required
+type Role struct {
+	// KeyIDs of the keys of the role
+	KeyIDs []string `json:"keyids"`
+	// Threshold is the number of keys that must sign the metadata
+	Threshold int `json:"threshold"`
+}
+
+// Common contains the fields shared by the metadata of all roles
+type Common struct {
+	// Type is the name of the role
+	Type string `json:"_type"`
+	// Version of the metadata, increased with every change
+	Version int64 `json:"version"`
+	// Expires is the time after which the metadata is no longer trusted
+	Expires time.Time `json:"expires"`
+}
+
+// Root metadata
+type Root struct {
+	Common
+	// Keys used by the roles by ID
+	Keys map[string]Key `json:"keys"`
+	// Roles by name
+	Roles map[string]Role `json:"roles"`
+}
+
+// Targets metadata
+type Targets struct {
+	Common
+	// Targets lists the target files by name
+	Targets map[string]TargetFile `json:"targets"`
+}
+
+// TargetFile describes a target file
+type TargetFile struct {
+	// Length of the file in bytes
+	Length int64 `json:"length"`
+	// Hashes of the file by algorithm, 'sha256' and 'sha512' are supported
+	Hashes map[string]string `json:"hashes"`
+}
+
+// Snapshot metadata
+type Snapshot struct {
+	Common
+	// Meta lists the version of the targets metadata
+	Meta map[string]MetaFile `json:"meta"`
+}
+
+// Timestamp metadata
+type Timestamp struct {
+	Common
+	// Meta lists the version of the snapshot metadata
+	Meta map[string]MetaFile `json:"meta"`
+}
+
+// MetaFile describes the version of a metadata file
+type MetaFile struct {
+	// Version of the metadata file
+	Version int64 `json:"version"`
+}
+
+// verifySignatures checks the metadata is signed by the threshold of keys
+// of the role
+func (root *Root) verifySignatures(roleName string, signed Signed) error {
+	role, ok := root.Roles[roleName]
+	if ok == false {
+		return fmt.Errorf("Role '%s' is not defined in the root metadata", roleName)
+	}
+	if role.Threshold < 1 {
+		return fmt.Errorf("Role '%s' has an invalid threshold %d", roleName, role.Threshold)
+	}
+
+	roleKeys := make(map[string]bool)
+	for _, keyID := range role.KeyIDs {
+		roleKeys[keyID] = true
+	}
+
+	// Each key counts once, no matter how many signatures it made
+	verified := make(map[string]bool)
+	for _, signature := range signed.Signatures {
+		if roleKeys[signature.KeyID] == false || verified[signature.KeyID] {
+			continue
+		}
+		key, ok := root.Keys[signature.KeyID]
+		if ok == false || key.Type != KeyTypeEd25519 || key.ID() != signature.KeyID {
+			continue
+		}
+		public, err := hex.DecodeString(key.Value.Public)
+		if err != nil || len(public) != ed25519.PublicKeySize {
+			continue
+		}
+		value, err := hex.DecodeString(signature.Signature)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(ed25519.PublicKey(public), signed.Signed, value) {
+			verified[signature.KeyID] = true
+		}
+	}
+
+	if len(verified) < role.Threshold {
+		return &MetadataError{
+			Role:   roleName,
+			Reason: ErrThreshold,
+			Detail: fmt.Sprintf("%d of %d signatures", len(verified), role.Threshold),
+		}
+	}
+	return nil
+}
+
+// decodeSigned parses a metadata file and the common fields of its signed
+// value, checking the type is the expected role
+func decodeSigned(content []byte, roleName string, value interface{}) (Signed, error) {
+	var signed Signed
+	err := json.Unmarshal(content, &signed)
+	if err != nil {
+		return Signed{}, fmt.Errorf("Invalid %s metadata: %s", roleName, err)
+	}
+	err = json.Unmarshal(signed.Signed, value)
+	if err != nil {
+		return Signed{}, fmt.Errorf("Invalid %s metadata: %s", roleName, err)
+	}
+	var common Common
+	json.Unmarshal(signed.Signed, &common)
+	if common.Type != roleName {
+		return Signed{}, fmt.Errorf(
+			"Invalid %s metadata: type is '%s'",
+			roleName,
+			common.Type)
+	}
+	return signed, nil
+}
+
+// checkExpiry returns ErrExpired if the metadata has expired
+func checkExpiry(roleName string, common Common, now time.Time) error {
+	if now.After(common.Expires) {
+		return &MetadataError{
+			Role:   roleName,
+			Reason: ErrExpired,
+			Detail: fmt.Sprintf("expired at %s", common.Expires),
+		}
+	}
+	return nil
+}
@@ -14,14 +14,16 @@
 package unattended
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
@@ -29,30 +31,94 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ProjectLimitless/go-unattended/omaha"
-	"github.com/cavaliercoder/grab"
+	"github.com/ProjectLimitless/go-unattended/tuf"
 	"github.com/otiai10/copy"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// maxResponseSize is the maximum size in bytes of an update response
+	maxResponseSize = 1 << 20
+	// tufDirectoryName is the directory in the state directory holding the
+	// trusted repository metadata
+	tufDirectoryName = "tuf"
+)
+
+// errStopRequested is returned when the target is not started because it was
+// stopped
+var errStopRequested = errors.New("Target was stopped")
+
 // Unattended implements the core functionality of the package. It takes
 // ownership of running and updating a target application
 type Unattended struct {
 	mutex               sync.Mutex
 	clientID            string
+	sessionID           string
+	platform            *omaha.OS
+	hw                  *omaha.HW
 	target              Target
 	updateCheckInterval time.Duration
-	outputWriter        io.Writer
+	stdoutWriter        io.Writer
+	stderrWriter        io.Writer
+	outputOptions       OutputOptions
+	outputLogger        *logrus.Entry
+	outputParsers       []LineParser
+	// outputMutex serialises writes of output lines
+	outputMutex sync.Mutex
 	// command holds the target application when executed
 	command          *exec.Cmd
 	commandCompleted bool
-	log              *logrus.Entry
-	waitGroup        sync.WaitGroup
+	// commandStopping is set once stopTarget stops command, the processes
+	// left in its process group are killed when it completed
+	commandStopping bool
+	// exited is closed once command has completed
+	exited chan struct{}
+	// process describes the running command
+	process TargetProcess
+	// restartRequested is set when the running target is stopped to be
+	// started again
+	restartRequested bool
+	// probation is set when the next started version was just updated and
+	// must be rolled back if it fails to start
+	probation bool
+	// previousVersion is the version of the target replaced by the version
+	// on probation
+	previousVersion string
+	// stopRequested is set when the target is stopped and must not be
+	// restarted
+	stopRequested bool
+	// stopSignal interrupts a restart waiting for its backoff delay
+	stopSignal chan struct{}
+	// health of the running target
+	health        Health
+	restartPolicy RestartPolicy
+	exitHistory   []ExitStatus
+	// progressHandler is called with the progress of package downloads
+	progressHandler ProgressHandler
+	// repository holds the trusted metadata when the target uses TUF
+	repository *tuf.Client
+	// eventsMutex serialises access to the queue of undelivered events and
+	// the state of its delivery
+	eventsMutex        sync.Mutex
+	deliveringEvents   bool
+	deliverEventsAgain bool
+	deliveryContext    context.Context
+	cancelDeliveries   context.CancelFunc
+	// deliveries tracks the running event delivery
+	deliveries sync.WaitGroup
+	// pingMutex serialises access to the dates of the last pings
+	pingMutex sync.Mutex
+	log       *logrus.Entry
+	waitGroup sync.WaitGroup
 }
 
-// New creates a new instance of the unattended updater
+// New creates a new instance of the unattended updater. The clientID
+// identifies the installation to the server, if empty a client ID is
+// generated and persisted in the target's VersionsPath
 func New(
 	clientID string,
 	target Target,
@@ -65,208 +131,703 @@ func New(
 			target.VersionsPath)
 	}
 
+	err := validateComponents(&target)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.ProbationPeriod == time.Duration(0) {
+		target.ProbationPeriod = DefaultProbationPeriod
+	}
+
+	if target.HealthCheckInterval == time.Duration(0) {
+		target.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if target.HealthCheckTimeout == time.Duration(0) {
+		target.HealthCheckTimeout = DefaultHealthCheckTimeout
+	}
+	if target.HealthCheckThreshold == 0 {
+		target.HealthCheckThreshold = DefaultHealthCheckThreshold
+	}
+
+	if target.ExtractionLimits.MaxTotalSize == 0 {
+		target.ExtractionLimits.MaxTotalSize = DefaultMaxExtractedSize
+	}
+	if target.ExtractionLimits.MaxFileSize == 0 {
+		target.ExtractionLimits.MaxFileSize = DefaultMaxExtractedFileSize
+	}
+	if target.ExtractionLimits.MaxFiles == 0 {
+		target.ExtractionLimits.MaxFiles = DefaultMaxExtractedFiles
+	}
+
+	if target.ExtractionHeadroom == 0 {
+		target.ExtractionHeadroom = DefaultExtractionHeadroom
+	}
+	if target.DownloadRetries == 0 {
+		target.DownloadRetries = DefaultDownloadRetries
+	}
+	if target.DownloadBackoff == time.Duration(0) {
+		target.DownloadBackoff = DefaultDownloadBackoff
+	}
+
+	if target.StopPolicy.Signal == nil {
+		target.StopPolicy.Signal = syscall.SIGTERM
+	}
+	if target.StopPolicy.GracePeriod == time.Duration(0) {
+		target.StopPolicy.GracePeriod = DefaultStopGracePeriod
+	}
+	if target.StopPolicy.ShutdownHookTimeout == time.Duration(0) {
+		target.StopPolicy.ShutdownHookTimeout = DefaultShutdownHookTimeout
+	}
+
 	if updateCheckInterval == time.Duration(0) {
 		return nil, fmt.Errorf(
 			"UpdateCheckInterval value of '%v' is invalid",
 			updateCheckInterval)
 	}
 
+	target.log = log
+	if clientID == "" {
+		clientID, err = installClientID(&target)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to generate client ID: %s", err)
+		}
+	}
+	sessionID, err := newUUID()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate session ID: %s", err)
+	}
+
 	updater := Unattended{
-		outputWriter:        os.Stdout,
+		stdoutWriter:        os.Stdout,
+		stderrWriter:        os.Stdout,
 		clientID:            clientID,
+		sessionID:           sessionID,
+		platform:            platformOS(),
+		hw:                  platformHW(),
 		target:              target,
 		updateCheckInterval: updateCheckInterval,
+		stopSignal:          make(chan struct{}, 1),
 		log:                 log,
 	}
 
+	if target.TUF != nil {
+		repository, err := tuf.NewClient(*target.TUF, target.statePath(tufDirectoryName))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load trusted metadata: %s", err)
+		}
+		updater.repository = repository
+	}
+
 	return &updater, nil
 }
 
-// SetOutputWriter sets the writer to write the target's output to
+// SetOutputWriter sets the writer to write the target's standard output and
+// standard error to
 func (updater *Unattended) SetOutputWriter(writer io.Writer) {
-	updater.outputWriter = writer
+	updater.SetStdoutWriter(writer)
+	updater.SetStderrWriter(writer)
+}
+
+// SetStdoutWriter sets the writer to write the target's standard output to
+func (updater *Unattended) SetStdoutWriter(writer io.Writer) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	updater.stdoutWriter = writer
+}
+
+// SetStderrWriter sets the writer to write the target's standard error to
+func (updater *Unattended) SetStderrWriter(writer io.Writer) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	updater.stderrWriter = writer
+}
+
+// SetOutputOptions sets how the lines of the target's output are formatted
+func (updater *Unattended) SetOutputOptions(options OutputOptions) {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	updater.outputOptions = options
 }
 
 // Run starts the target application and the update check loop.
 //
 // If any updates are found for targets in UpdateManifests they will be
-// downloaded, applied and the target application restarted
-func (updater *Unattended) Run() error {
+// downloaded, applied and the target application restarted. Cancelling the
+// context stops the update check loop and the target. Run returns once the
+// target and the update check loop have completed
+func (updater *Unattended) Run(ctx context.Context) error {
 	updater.log.WithField(
 		"check_interval", updater.updateCheckInterval,
 	).Info("Starting service with update checking enabled")
-	time.AfterFunc(updater.updateCheckInterval, updater.handleUpdates)
-	return updater.RunWithoutUpdate()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	checksCompleted := make(chan struct{})
+	go func() {
+		defer close(checksCompleted)
+		updater.checkForUpdates(ctx)
+	}()
+
+	err := updater.RunWithoutUpdate(ctx)
+	cancel()
+	<-checksCompleted
+	// Update checks may have started a delivery after the target completed
+	updater.stopDeliveries()
+	return err
+}
+
+// checkForUpdates runs handleUpdates every updateCheckInterval until the
+// context is cancelled
+func (updater *Unattended) checkForUpdates(ctx context.Context) {
+	timer := time.NewTimer(updater.updateCheckInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		updater.handleUpdates(ctx)
+		timer.Reset(updater.updateCheckInterval)
+	}
+}
+
+// RunWithoutUpdate starts the target application without checking for updates.
+//
+// It returns once the target completes, unless a restart was requested or
+// the restart policy restarts the target. Restarts start the latest version.
+// Cancelling the context stops the target
+func (updater *Unattended) RunWithoutUpdate(ctx context.Context) error {
+	updater.mutex.Lock()
+	updater.stopRequested = false
+	updater.mutex.Unlock()
+	select {
+	case <-updater.stopSignal:
+	default:
+	}
+	// Events are delivered until the target completes, undelivered events
+	// are delivered on the next run
+	updater.beginDeliveries(ctx)
+	defer updater.stopDeliveries()
+
+	// Stop the target once the context is cancelled
+	completed := make(chan struct{})
+	watcherCompleted := make(chan struct{})
+	defer func() {
+		close(completed)
+		<-watcherCompleted
+	}()
+	go func() {
+		defer close(watcherCompleted)
+		select {
+		case <-ctx.Done():
+			err := updater.Stop()
+			if err != nil {
+				updater.log.Warningf("Unable to stop target: %s", err)
+			}
+		case <-completed:
+		}
+	}()
+
+	var limiter startLimiter
+	attempt := 0
+	for {
+		updater.mutex.Lock()
+		if updater.stopRequested {
+			updater.mutex.Unlock()
+			return nil
+		}
+		inProbation := updater.probation
+		previousVersion := updater.previousVersion
+		updater.probation = false
+		updater.restartRequested = false
+		updater.mutex.Unlock()
+
+		version := updater.target.LatestVersion()
+		started := time.Now()
+		exited, monitor, err := updater.startTarget(version)
+		if err == errStopRequested {
+			return nil
+		}
+		if err != nil {
+			if inProbation && updater.isStopRequested() == false {
+				err = updater.rollback(version, EventErrorCodeStart, err)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			updater.recordExit(ExitStatus{
+				Version: version,
+				Code:    -1,
+				Err:     err,
+				Time:    time.Now(),
+			})
+		} else {
+			if inProbation {
+				err = updater.waitProbation(version, exited, monitor)
+				if err != nil && updater.isStopRequested() {
+					return nil
+				}
+				if err != nil {
+					err = updater.rollback(version, EventErrorCodeProbation, err)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				updater.reportEvent(updater.targetInstallation(), version, omaha.Event{
+					Type:            omaha.EventTypeInstall,
+					Result:          omaha.EventResultTypeSuccessRestarted,
+					PreviousVersion: previousVersion,
+					NextVersion:     version,
+				})
+			}
+
+			select {
+			case <-exited:
+			case err = <-monitor.unhealthy:
+				updater.log.WithField(
+					"version", version,
+				).Warningf("Target is unhealthy, restarting: %s", err)
+				_, err = updater.requestRestart()
+				if err != nil {
+					return err
+				}
+				<-exited
+			}
+		}
+
+		updater.mutex.Lock()
+		restart := updater.restartRequested
+		stopped := updater.stopRequested
+		policy := updater.restartPolicy
+		updater.mutex.Unlock()
+		if stopped {
+			return nil
+		}
+		if restart {
+			continue
+		}
+
+		// The target completed on its own, restart it if the policy allows
+		exits := updater.ExitHistory()
+		if len(exits) == 0 || policy.shouldRestart(exits[len(exits)-1]) == false {
+			return err
+		}
+		if limiter.allow(policy) == false {
+			return fmt.Errorf(
+				"Target restarted more than %d times in %s, giving up",
+				policy.StartLimitBurst,
+				policy.StartLimitInterval)
+		}
+		if time.Since(started) >= policy.MaxBackoff {
+			attempt = 0
+		}
+		delay := policy.backoff(attempt)
+		attempt++
+
+		updater.log.WithFields(logrus.Fields{
+			"exit_code": exits[len(exits)-1].Code,
+			"signal":    exits[len(exits)-1].Signal,
+			"delay":     delay,
+		}).Warning("Target completed, restarting")
+		if updater.waitBackoff(delay) == false {
+			return nil
+		}
+	}
+}
+
+// waitBackoff waits for the delay before a restart. It returns false if the
+// target was stopped while waiting
+func (updater *Unattended) waitBackoff(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-updater.stopSignal:
+	}
+
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	return updater.stopRequested == false
 }
 
-// RunWithoutUpdate starts the target application without checking for updates
-func (updater *Unattended) RunWithoutUpdate() error {
-	updater.command = exec.Command(
+// startTarget starts the given version of the target application and
+// monitors its health. The returned channel is closed once the target has
+// completed
+func (updater *Unattended) startTarget(version string) (chan struct{}, *healthMonitor, error) {
+	command := exec.Command(
 		filepath.Join(
 			updater.target.VersionsPath,
-			updater.target.LatestVersion(),
+			version,
 			updater.target.ApplicationName,
 		),
 		updater.target.ApplicationParameters...)
-	// TODO: Do we need to set a process group on Linux?
-	// updater.command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	commandOutPipe, err := updater.command.StdoutPipe()
+	configureProcess(command, updater.target)
+	// The target marks itself active by touching the active file
+	activePath := updater.target.statePath(activeFileName)
+	err := os.MkdirAll(filepath.Dir(activePath), 0755)
 	if err != nil {
-		return fmt.Errorf("Unable to start reading miner output")
+		updater.log.Warningf("Unable to create state directory: %s", err)
 	}
-	commandErrPipe, err := updater.command.StderrPipe()
+	command.Env = append(os.Environ(), ActiveFileEnv+"="+activePath)
+	// The pipes are created here instead of with StdoutPipe, Wait would
+	// close the read ends before all output is forwarded
+	commandOutPipe, commandOutWriter, err := os.Pipe()
 	if err != nil {
-		return fmt.Errorf("Unable to start reading miner error output")
+		return nil, nil, fmt.Errorf("Unable to start reading miner output")
+	}
+	commandErrPipe, commandErrWriter, err := os.Pipe()
+	if err != nil {
+		commandOutPipe.Close()
+		commandOutWriter.Close()
+		return nil, nil, fmt.Errorf("Unable to start reading miner error output")
+	}
+	command.Stdout = commandOutWriter
+	command.Stderr = commandErrWriter
+
+	// The target is started and registered under the lock Stop uses, a
+	// stop requested before the start is never missed
+	updater.mutex.Lock()
+	if updater.stopRequested {
+		updater.mutex.Unlock()
+		commandOutPipe.Close()
+		commandOutWriter.Close()
+		commandErrPipe.Close()
+		commandErrWriter.Close()
+		return nil, nil, errStopRequested
+	}
+	for _, writer := range []io.Writer{updater.stdoutWriter, updater.stderrWriter} {
+		if versionedWriter, ok := writer.(VersionedWriter); ok {
+			err := versionedWriter.SetVersion(version)
+			if err != nil {
+				updater.log.Warningf("Unable to switch output to version %s: %s", version, err)
+			}
+		}
 	}
 
-	err = updater.command.Start()
+	waited, err := startCommand(command, updater.target.KillWithSupervisor, func() {
+		// Child processes left behind by a stopped target would keep the
+		// output open and hold on to its resources. Children of a target
+		// that completed on its own are left running
+		updater.mutex.Lock()
+		stopping := updater.command == command && updater.commandStopping
+		updater.mutex.Unlock()
+		if stopping {
+			cleanupProcessGroup(command.Process)
+		}
+	})
+	// The target holds its own copies of the write ends, the output is
+	// complete once the target and its children closed them
+	commandOutWriter.Close()
+	commandErrWriter.Close()
 	if err != nil {
-		return err
+		updater.mutex.Unlock()
+		commandOutPipe.Close()
+		commandErrPipe.Close()
+		return nil, nil, err
+	}
+
+	exited := make(chan struct{})
+	process := TargetProcess{
+		PID:     command.Process.Pid,
+		Version: version,
+		Started: time.Now(),
+		Running: true,
 	}
+	updater.command = command
+	updater.commandCompleted = false
+	updater.commandStopping = false
+	updater.exited = exited
+	updater.process = process
+	updater.mutex.Unlock()
 
-	// Keep copying the output from the process and send to the stream
-	updater.waitGroup.Add(1)
+	// Keep copying the output from the process and send to the streams,
+	// both streams are read concurrently so neither can fill up and block
+	// the target
+	updater.waitGroup.Add(2)
+	go func() {
+		defer func() {
+			commandOutPipe.Close()
+			updater.waitGroup.Done()
+		}()
+		updater.forwardOutput(process, StreamStdout, commandOutPipe)
+	}()
 	go func() {
 		defer func() {
+			commandErrPipe.Close()
 			updater.waitGroup.Done()
 		}()
-		io.Copy(updater.outputWriter, commandOutPipe)
-		io.Copy(updater.outputWriter, commandErrPipe)
+		updater.forwardOutput(process, StreamStderr, commandErrPipe)
 	}()
 
-	updater.mutex.Lock()
-	updater.commandCompleted = false
-	updater.mutex.Unlock()
+	go func() {
+		err := <-waited
+		if err != nil {
+			updater.log.Infof("Target completed: %s", err)
+		}
+		// Forward the remaining output before the exit is recorded
+		updater.waitOutput(commandOutPipe, commandErrPipe)
+		updater.recordExit(exitStatusFromState(
+			version,
+			command.Process.Pid,
+			command.ProcessState,
+			err))
+
+		updater.mutex.Lock()
+		updater.commandCompleted = true
+		updater.process.Running = false
+		updater.mutex.Unlock()
+		close(exited)
+	}()
+
+	return exited, updater.monitorHealth(process, exited), nil
+}
+
+// startCommand starts the command and returns the channel receiving the
+// result of waiting for it, see waitTarget for beforeReap. With lockThread
+// the command is started and waited for on a locked OS thread, the parent
+// death signal of the target fires when the thread that started it exits
+func startCommand(command *exec.Cmd, lockThread bool, beforeReap func()) (chan error, error) {
+	started := make(chan error, 1)
+	waited := make(chan error, 1)
+	go func() {
+		if lockThread {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+		}
+		err := command.Start()
+		started <- err
+		if err != nil {
+			return
+		}
+		waited <- waitTarget(command, beforeReap)
+	}()
 
-	err = updater.command.Wait()
+	err := <-started
 	if err != nil {
-		updater.log.Infof("Target completed: %s", err)
+		return nil, err
 	}
-	updater.mutex.Lock()
-	updater.commandCompleted = true
-	updater.mutex.Unlock()
+	return waited, nil
+}
 
-	updater.waitGroup.Wait()
-	return nil
+// waitOutput waits until the output of the completed target is forwarded.
+// The output is closed outputDrainTimeout after the target completed, even
+// if processes that escaped the process group still write to it
+func (updater *Unattended) waitOutput(pipes ...io.Closer) {
+	drained := make(chan struct{})
+	go func() {
+		updater.waitGroup.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(outputDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return
+	case <-timer.C:
+	}
+	updater.log.WithField(
+		"timeout", outputDrainTimeout,
+	).Warning("Target output still open after it completed, closing, output may be truncated")
+	for _, pipe := range pipes {
+		pipe.Close()
+	}
+	<-drained
+}
+
+// isStopRequested returns true if the target was stopped
+func (updater *Unattended) isStopRequested() bool {
+	updater.mutex.Lock()
+	defer updater.mutex.Unlock()
+	return updater.stopRequested
 }
 
 // Stop the target application
 func (updater *Unattended) Stop() error {
 	updater.mutex.Lock()
-	defer updater.mutex.Unlock()
+	updater.restartRequested = false
+	updater.stopRequested = true
+	updater.mutex.Unlock()
+
+	// Interrupt a restart waiting for its backoff delay
+	select {
+	case updater.stopSignal <- struct{}{}:
+	default:
+	}
+	err := updater.stopTarget()
+	updater.stopDeliveries()
+	return err
+}
+
+// stopTarget stops the running target application. The target is first
+// stopped gracefully as defined by the target's StopPolicy
+func (updater *Unattended) stopTarget() error {
+	updater.mutex.Lock()
 	cmd := updater.command
+	completed := updater.commandCompleted
+	exited := updater.exited
+	process := updater.process
+	if cmd != nil && completed == false {
+		updater.commandStopping = true
+	}
+	updater.mutex.Unlock()
 
 	if cmd == nil {
 		return nil
 	}
-	if cmd.Process == nil {
+	if cmd.Process == nil || completed {
 		return nil
 	}
 
 	updater.log.Infof("Stopping target, PID %d", cmd.Process.Pid)
+	if updater.stopGracefully(cmd, process, exited) {
+		updater.log.Info("Target stopped")
+		return nil
+	}
 
-	//
-	// Simplified attempt at killing spree
-	// os.Interrupt signal isn't available on Windows, so we're just
-	// killing the processes
-	//
-	// This doesn't work reliably when unattended is used by a Windows service
-	// that spawns a sub-unattended managed service. It needs some work.
-	//
-	if strings.ToLower(runtime.GOOS) == "linux" || strings.ToLower(runtime.GOOS) == "darwin" {
-		// updater.log.Info("Releasing target process")
-		// err := cmd.Process.Release()
-		// if err != nil {
-		// 	updater.log.Warningf("Target could not be released: %s", err)
-		// 	// Return nil, there isn't much we can do now...
-		// 	return nil
-		// }
-		updater.log.Info("Killing target process")
-		err := cmd.Process.Kill()
-		if err != nil {
-			updater.log.Warningf("Target could not be killed: %s", err)
-			// Return nil, there isn't much we can do now...
-			return nil
-		}
-
-	} else if strings.ToLower(runtime.GOOS) == "windows" {
-		updater.log.Info("Killing target process with taskkill")
-		// Some processes just need to be force killed on Windows, many many
-		// tests showed Windows not killing it when process.Kill is used.
-		// This is especially true when this runs as a service
-		_, err := exec.Command(
-			"taskkill",
-			"/F",   // Force
-			"/PID", // by process ID
-			fmt.Sprintf("%d", cmd.Process.Pid),
-		).Output()
-		if err != nil {
-			updater.log.Warningf("Target could not be taskkilled: %s", err)
-			// Return nil, there isn't much we can do now...
-			return nil
-		}
+	err := updater.killTarget(cmd.Process)
+	if err != nil {
+		updater.log.Warningf("Target could not be killed: %s", err)
+		// Return nil, there isn't much we can do now...
+		return nil
 	}
 
 	updater.log.Info("Target stopped")
 	return nil
 }
 
-// Restart the target application
-func (updater *Unattended) Restart() error {
+// Restart the target application. A running target is stopped and started
+// again by RunWithoutUpdate, otherwise the target is started with the
+// given context
+func (updater *Unattended) Restart(ctx context.Context) error {
 	updater.log.Info("Restarting target")
-	err := updater.Stop()
-	if err != nil {
-		// TODO: ROLLBACK
-		return err
+	running, err := updater.requestRestart()
+	if running == false {
+		return updater.RunWithoutUpdate(ctx)
 	}
-	return updater.RunWithoutUpdate()
+	return err
+}
+
+// requestRestart stops the running target to be started again by
+// RunWithoutUpdate. It returns false if the target isn't running
+func (updater *Unattended) requestRestart() (bool, error) {
+	updater.mutex.Lock()
+	running := updater.command != nil && updater.commandCompleted == false
+	updater.restartRequested = running
+	updater.mutex.Unlock()
+
+	if running == false {
+		return false, nil
+	}
+	return true, updater.stopTarget()
 }
 
 // handleUpdates runs at updateCheckInterval to check for and apply updates
-func (updater *Unattended) handleUpdates() {
+func (updater *Unattended) handleUpdates(ctx context.Context) {
+
+	// Deliver the events queued while the server was not reachable
+	updater.startDelivery()
 
 	updater.log.Debug("Checking for updates...")
-	updated, err := updater.ApplyUpdates()
+	previousVersion := updater.target.LatestVersion()
+	previousVersions := updater.latestVersions()
+	updated, err := updater.ApplyUpdates(ctx)
 	if err != nil {
 		updater.log.Warningf("Unable to check for updates: %s", err)
 	}
+	// Only restart if a version that runs has changed
+	if updated && updater.latestVersions() == previousVersions {
+		updater.log.Debug("No installed versions changed")
+		updated = false
+	}
 	if updated {
+		newVersion := updater.target.LatestVersion()
 		updater.log.WithField(
-			"new_version", updater.target.LatestVersion(),
+			"new_version", newVersion,
 		).Info("Software updated")
-		// Restart the application
-		// TODO: Check if we are leaking a goroutine here
-		go func() {
-			err = updater.Restart()
-			if err != nil {
-				// TODO: ROLLBACK
-				updater.log.Fatalf("Unable to restart target: %s", err)
-			}
-		}()
+		// Restart the application, a new version of the target is on
+		// probation until it has been running for the probation period.
+		// Updated components only require the restart
+		if newVersion != previousVersion {
+			updater.mutex.Lock()
+			updater.probation = true
+			updater.previousVersion = previousVersion
+			updater.mutex.Unlock()
+		}
+		updater.log.Info("Restarting target")
+		_, err := updater.requestRestart()
+		if err != nil {
+			updater.log.Errorf("Unable to restart target: %s", err)
+		}
 	} else {
 		updater.log.Debug("No updates available")
 	}
-	time.AfterFunc(updater.updateCheckInterval, updater.handleUpdates)
 }
 
-// ApplyUpdates downloads and applies downloads if they are available
-func (updater *Unattended) ApplyUpdates() (bool, error) {
-
-	currentVersion := updater.target.LatestVersion()
+// ApplyUpdates downloads and applies downloads if they are available.
+// Cancelling the context aborts the update and removes incomplete versions
+func (updater *Unattended) ApplyUpdates(ctx context.Context) (bool, error) {
 
-	omahaManifests, err := updater.getAvailableUpdates()
+	updates, err := updater.getAvailableUpdates(ctx)
 	if err != nil {
 		return false, fmt.Errorf("Unable to get updates: %s", err)
 	}
-	if len(omahaManifests) == 0 {
-		return false, nil
+	// Partial downloads are kept across update checks, until their package
+	// is no longer offered
+	omahaManifests := make([]omaha.Manifest, len(updates))
+	for i, update := range updates {
+		omahaManifests[i] = update.manifest
+	}
+	updater.pruneDownloads(omahaManifests)
+
+	// Rollbacks to installed versions need no download
+	updated := false
+	var downloads []availableUpdate
+	for _, update := range updates {
+		if update.rollback == false || updater.isInstalled(update) == false {
+			downloads = append(downloads, update)
+			continue
+		}
+		previousVersion := updater.latestVersion(update.installation)
+		if previousVersion == update.manifest.Version {
+			continue
+		}
+		err := updater.markNewerVersionsBad(update.installation, update.manifest.Version)
+		if err != nil {
+			updater.log.WithFields(logrus.Fields{
+				"app_id":  update.installation.appID,
+				"version": update.manifest.Version,
+			}).Errorf("Unable to roll back: %s", err)
+			continue
+		}
+		updater.reportInstallEvent(
+			update.installation,
+			previousVersion,
+			update.manifest,
+			omaha.EventResultTypeSuccess)
+		updated = true
+	}
+	updates = downloads
+
+	if len(updates) == 0 {
+		return updated, nil
+	}
+	if updater.inDownloadWindow(time.Now()) == false {
+		updater.log.WithField(
+			"updates", len(updates),
+		).Info("Updates found, postponing download until the download window")
+		return updated, nil
 	}
 
 	updater.log.WithField(
-		"updates", len(omahaManifests),
+		"updates", len(updates),
 	).Debug("Updates found, download...")
 
-	tempPath := filepath.Join(updater.target.VersionsPath, "tmp")
+	tempPath := filepath.Join(updater.target.VersionsPath, tempDirectoryName)
 	//Remove/clean the temp directory
 	err = os.RemoveAll(tempPath)
 	if err != nil {
@@ -283,15 +844,42 @@ func (updater *Unattended) ApplyUpdates() (bool, error) {
 			"Unable to create temp download path at '%s': %s",
 			tempPath,
 			err)
-		return false, err
+		return updated, err
 	}
 
 	updater.log.WithField(
 		"path", tempPath,
 	).Debugf("Temp path set")
+	defer func() {
+		err := os.RemoveAll(tempPath)
+		if err != nil {
+			updater.log.Warningf("Unable to remove temp download path: %s", err)
+		}
+	}()
+
+	for _, update := range updates {
+		omahaManifest := update.manifest
+		extractor, err := updater.packageExtractor(
+			omahaManifest.Package,
+			update.installation.binaryName)
+		if err != nil {
+			updater.log.WithFields(logrus.Fields{
+				"app_id":          update.installation.appID,
+				"package":         omahaManifest.Package.Name,
+				"package_version": omahaManifest.Version,
+				"reason":          err,
+			}).Errorf("Unable to apply package")
+			continue
+		}
 
-	for _, omahaManifest := range omahaManifests {
-		downloadPath, err := updater.DownloadAndVerifyPackage(omahaManifest, tempPath)
+		downloadPath, err := updater.downloadUpdate(ctx, update, tempPath)
+		if err == ErrOutsideDownloadWindow {
+			updater.log.WithFields(logrus.Fields{
+				"package":         omahaManifest.Package.Name,
+				"package_version": omahaManifest.Version,
+			}).Info("Download paused until the download window")
+			return updated, nil
+		}
 		if err != nil {
 			updater.log.WithFields(logrus.Fields{
 				"package":         omahaManifest.Package.Name,
@@ -299,6 +887,9 @@ func (updater *Unattended) ApplyUpdates() (bool, error) {
 				"reason":          err,
 			}).Errorf("Unable to download package")
 
+			if ctx.Err() != nil {
+				return updated, ctx.Err()
+			}
 			continue
 		}
 
@@ -307,139 +898,209 @@ func (updater *Unattended) ApplyUpdates() (bool, error) {
 			"package_version": omahaManifest.Version,
 		}).Debug("Downloaded package")
 
-		// Get new version path
-		newVersionPath := filepath.Join(updater.target.VersionsPath, omahaManifest.Version)
-		updater.log.WithField(
-			"path", newVersionPath,
-		).Debugf("New version path set")
-
-		// Clone the current version into new version
-		// If no versions are currently installed, create the new path
-		// Note: From this point on the new version folder might exist, in case of
-		// rollback, remove this version
-		currentVersionPath := filepath.Join(updater.target.VersionsPath, currentVersion)
-		if _, err = os.Stat(currentVersionPath); err == nil {
-			err = copy.Copy(
-				filepath.Join(updater.target.VersionsPath, currentVersion),
-				newVersionPath,
-			)
-			if err != nil {
-				return false, updater.undoIncomplete(newVersionPath, err)
-			}
-		} else {
-			// No current version exists, create the path
-			err = os.MkdirAll(newVersionPath, 0755)
-			if err != nil {
-				return false, updater.undoIncomplete(newVersionPath, err)
-			}
-		}
-		// Override files from package in new dir / apply update
-		// Start with the gz part of the tar.gz file
-		downloadedPackage, err := os.Open(downloadPath)
-		if err != nil {
-			return false, updater.undoIncomplete(newVersionPath, err)
+		// A rollback is installed over the latest version older than it
+		currentVersion := updater.latestVersion(update.installation)
+		baseVersion := currentVersion
+		if update.rollback {
+			version, _ := update.installation.scheme.Parse(omahaManifest.Version)
+			baseVersion = updater.latestVersionBefore(update.installation, version)
 		}
-		gzReader, err := gzip.NewReader(downloadedPackage)
+		err = updater.installPackage(ctx, update, baseVersion, extractor, downloadPath)
 		if err != nil {
-			return false, updater.undoIncomplete(newVersionPath, err)
-		}
-
-		tarReader := tar.NewReader(gzReader)
-		// Go through all files in tar archive
-		for {
-			header, err := tarReader.Next()
+			result := omaha.EventResultTypeError
+			if ctx.Err() != nil {
+				result = omaha.EventResultTypeCancelled
+			}
+			updater.reportInstallEvent(update.installation, currentVersion, omahaManifest, result)
+			updater.log.WithFields(logrus.Fields{
+				"app_id":          update.installation.appID,
+				"package":         omahaManifest.Package.Name,
+				"package_version": omahaManifest.Version,
+				"reason":          err,
+			}).Errorf("Unable to install package")
 
-			// No more
-			if err == io.EOF {
-				break
+			// Updates installed before still need the restart
+			if ctx.Err() != nil {
+				return updated, ctx.Err()
 			}
+			continue
+		}
+		if update.rollback {
+			err = updater.markNewerVersionsBad(update.installation, omahaManifest.Version)
 			if err != nil {
-				// Next!
-				continue
+				updater.log.WithFields(logrus.Fields{
+					"app_id":  update.installation.appID,
+					"version": omahaManifest.Version,
+				}).Errorf("Unable to roll back: %s", err)
 			}
+		}
+		updater.reportInstallEvent(
+			update.installation,
+			currentVersion,
+			omahaManifest,
+			omaha.EventResultTypeSuccess)
+		updated = true
+	}
 
-			// get the filename in the archive
-			filename := header.Name
-			destinationPath := filepath.Join(newVersionPath, filename)
-			switch header.Typeflag {
-			case tar.TypeDir:
-				// Create directories if needed
-				err := os.MkdirAll(destinationPath, header.FileInfo().Mode())
-				if err != nil {
-					return false, updater.undoIncomplete(newVersionPath, err)
-				}
-			case tar.TypeReg:
-				// Create the new file in the destination path
-				destinationFile, err := os.OpenFile(
-					destinationPath,
-					os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
-					header.FileInfo().Mode())
-				if err != nil {
-					return false, updater.undoIncomplete(newVersionPath, err)
-				}
-				defer destinationFile.Close()
+	return updated, nil
+}
 
-				written, err := io.Copy(destinationFile, tarReader)
-				if err != nil {
-					return false, updater.undoIncomplete(newVersionPath, err)
-				}
-				destinationFile.Close()
+// installPackage installs the downloaded package of the update into a new
+// version directory, based on a copy of the current version
+func (updater *Unattended) installPackage(
+	ctx context.Context,
+	update availableUpdate,
+	currentVersion string,
+	extractor Extractor,
+	downloadPath string) error {
 
-				if written != header.Size {
-					return false, updater.undoIncomplete(newVersionPath, fmt.Errorf(
-						"Written bytes differ from original file. Expected %d, wrote %d",
-						header.Size,
-						written))
-				}
-				updater.log.WithField(
-					"path", destinationPath,
-				).Debugf("Updated file")
-			default:
-				updater.log.Warningf("Unable to determine type, found: %c %s %s\n",
-					header.Typeflag,
-					"in file",
-					filename,
-				)
-			}
-		}
-		err = gzReader.Close()
+	versionsPath := update.installation.versionsPath
+
+	// Get new version path
+	newVersionPath := filepath.Join(versionsPath, update.manifest.Version)
+	updater.log.WithField(
+		"path", newVersionPath,
+	).Debugf("New version path set")
+	// An existing version is never overwritten, or removed on failure
+	if _, err := os.Lstat(newVersionPath); err == nil {
+		return fmt.Errorf("Version directory '%s' already exists", newVersionPath)
+	}
+
+	// Clone the current version into new version
+	// If no versions are currently installed, create the new path
+	// Note: From this point on the new version folder might exist, in case of
+	// rollback, remove this version
+	currentVersionPath := filepath.Join(versionsPath, currentVersion)
+	if _, err := os.Stat(currentVersionPath); err == nil {
+		err = copy.Copy(
+			currentVersionPath,
+			newVersionPath,
+		)
 		if err != nil {
-			updater.log.Warningf("Unable to close gz: %s", err)
+			return updater.undoIncomplete(newVersionPath, err)
 		}
-
-		err = downloadedPackage.Close()
+	} else {
+		// No current version exists, create the path
+		err = os.MkdirAll(newVersionPath, 0755)
 		if err != nil {
-			updater.log.Warningf("Unable to close package: %s", err)
+			return updater.undoIncomplete(newVersionPath, err)
 		}
-
 	}
-
-	err = os.RemoveAll(tempPath)
+	// Override files from package in new dir / apply update
+	err := extractor.Extract(ctx, downloadPath, newVersionPath)
 	if err != nil {
-		updater.log.Warningf("Unable to remove temp download path: %s", err)
+		return updater.undoIncomplete(newVersionPath, err)
 	}
-
-	return true, nil
+	return nil
 }
 
 // DownloadAndVerifyPackage downloads and verifies the package from the
-// given manifest and returns the downloaded location
+// given manifest and returns the downloaded location. Cancelling the context
+// aborts the download. The progress is reported to the progress handler and
+// the download is reported to the update endpoint as download events
 func (updater *Unattended) DownloadAndVerifyPackage(
+	ctx context.Context,
 	manifest omaha.Manifest,
 	tempPath string) (string, error) {
 
+	return updater.downloadUpdate(ctx, availableUpdate{
+		installation: updater.targetInstallation(),
+		manifest:     manifest,
+	}, tempPath)
+}
+
+// downloadUpdate downloads and verifies the package of the update, reporting
+// the download for the installation of the update
+func (updater *Unattended) downloadUpdate(
+	ctx context.Context,
+	update availableUpdate,
+	tempPath string) (string, error) {
+
+	manifest := update.manifest
+	tracker := updater.newProgressTracker(
+		manifest.Package.Name,
+		manifest.Version,
+		int64(manifest.Package.SizeInBytes))
+	updater.reportDownloadEvent(
+		update.installation,
+		manifest,
+		omaha.EventResultTypeStarted,
+		tracker.current())
+	downloadPath, err := updater.downloadAndVerifyPackage(ctx, manifest, tempPath, tracker)
+	result := omaha.EventResultTypeError
+	switch {
+	case err == nil:
+		result = omaha.EventResultTypeSuccess
+	case ctx.Err() != nil || err == ErrOutsideDownloadWindow:
+		result = omaha.EventResultTypeCancelled
+	}
+	updater.reportDownloadEvent(update.installation, manifest, result, tracker.current())
+	return downloadPath, err
+}
+
+// downloadAndVerifyPackage downloads and verifies the package, tracking the
+// progress of the download
+func (updater *Unattended) downloadAndVerifyPackage(
+	ctx context.Context,
+	manifest omaha.Manifest,
+	tempPath string,
+	tracker *progressTracker) (string, error) {
+
 	updater.log.WithField(
 		"name", manifest.Package.Name,
 	).Debugf("Downloading package")
 
+	// The package is downloaded into the temp directory under its name
+	err := checkPackageName(manifest.Package.Name)
+	if err != nil {
+		return "", err
+	}
+
+	// Only download packages listed in the trusted targets metadata
+	var targetFile tuf.TargetFile
+	if updater.repository != nil {
+		err := updater.repository.Update(ctx)
+		if err != nil {
+			return "", fmt.Errorf("Unable to update trusted metadata: %s", err)
+		}
+		targetFile, err = updater.repository.Target(manifest.Package.Name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// The size in the trusted targets metadata takes precedence. Packages
+	// without a size are limited to the maximum extracted size
+	declaredSize := int64(manifest.Package.SizeInBytes)
+	if updater.repository != nil {
+		declaredSize = targetFile.Length
+	}
+	tracker.expect(declaredSize)
+	maxSize := declaredSize
+	if declaredSize == 0 {
+		maxSize = updater.target.ExtractionLimits.MaxTotalSize
+	} else {
+		err := updater.checkDiskSpace(tempPath, declaredSize)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	downloadPath := filepath.Join(tempPath, manifest.Package.Name)
-	response, err := grab.Get(downloadPath, manifest.DownloadURL.Codebase)
+	err = updater.downloadFile(
+		ctx,
+		manifest.DownloadURL.Codebase,
+		downloadKey(manifest),
+		downloadPath,
+		declaredSize,
+		maxSize,
+		tracker)
 	if err != nil {
 		return "", err
 	}
 
 	hasher := sha256.New()
-	downloadedFile, err := os.Open(response.Filename)
+	downloadedFile, err := os.Open(downloadPath)
 	if err != nil {
 		return "", fmt.Errorf(
 			"Unable to access: %s",
@@ -452,113 +1113,289 @@ func (updater *Unattended) DownloadAndVerifyPackage(
 			err)
 	}
 
-	if manifest.Package.SHA256Hash != hex.EncodeToString(hasher.Sum(nil)) {
+	digest := hasher.Sum(nil)
+	if updater.repository != nil {
+		// The targets metadata replaces the hash of the manifest
+		_, err = downloadedFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", fmt.Errorf("Could not be verified: %s", err)
+		}
+		err = targetFile.Verify(downloadedFile)
+		if err != nil {
+			return "", fmt.Errorf("Failed verification: %s", err)
+		}
+	} else if manifest.Package.SHA256Hash != hex.EncodeToString(digest) {
 		return "", fmt.Errorf("Failed verification")
 	}
+	err = updater.verifyPackageSignature(ctx, manifest, digest)
+	if err != nil {
+		return "", fmt.Errorf("Failed signature verification: %s", err)
+	}
 
-	return response.Filename, nil
+	return downloadPath, nil
 }
 
-// isUpdateAvailable checks if an update is available for the target and returns
-// the available package if true
-func (updater *Unattended) isUpdateAvailable() (bool, omaha.Manifest, error) {
-	currentVersion := updater.target.LatestVersion()
-	updater.log.WithFields(logrus.Fields{
-		"app_id":          updater.target.AppID,
-		"current_version": currentVersion,
-		"update_endpoint": updater.target.UpdateEndpoint,
-	}).Debug("Checking for update")
+// isUpdateAvailable checks the response of the server for the installation
+// and returns the available update if true
+func (updater *Unattended) isUpdateAvailable(
+	installation installation,
+	currentVersion string,
+	omahaApp omaha.App) (bool, availableUpdate, error) {
+
+	// Error getting update information
+	if omahaApp.Status != "ok" {
+		return false, availableUpdate{}, fmt.Errorf(
+			"Received app status %s: %s",
+			omahaApp.Status,
+			omahaApp.Reason)
+	}
+	if omahaApp.UpdateCheck == nil {
+		return false, availableUpdate{}, fmt.Errorf("Response has no update check")
+	}
+	// No update is available
+	if omahaApp.UpdateCheck.Status == "noupdate" {
+		return false, availableUpdate{}, nil
+	}
+	if omahaApp.UpdateCheck.Status != "ok" {
+		return false, availableUpdate{}, fmt.Errorf(
+			"%s",
+			omahaApp.UpdateCheck.Status)
+	}
+	// The version is used as the name of the version directory
+	version := omahaApp.UpdateCheck.Manifest.Version
+	err := checkVersionName(version)
+	if err != nil {
+		return false, availableUpdate{}, err
+	}
+	// The package name is used as the name of the downloaded file
+	err = checkPackageName(omahaApp.UpdateCheck.Manifest.Package.Name)
+	if err != nil {
+		return false, availableUpdate{}, err
+	}
+	// Versions that failed probation are never installed again
+	if updater.badVersions(installation)[version] {
+		updater.log.WithFields(logrus.Fields{
+			"app_id":  installation.appID,
+			"version": version,
+		}).Info("Skipping update to a version that failed before")
+		return false, availableUpdate{}, nil
+	}
+	rollback, err := checkDowngrade(installation.scheme, currentVersion, *omahaApp.UpdateCheck)
+	if err != nil {
+		return false, availableUpdate{}, err
+	}
+	return true, availableUpdate{
+		installation: installation,
+		manifest:     omahaApp.UpdateCheck.Manifest,
+		rollback:     rollback,
+	}, nil
+}
 
-	// TODO: Convert unattended to proper semver
-	// _, err := semver.Parse("1.0.0-dev")
-	// if err != nil {
-	// 	panic(err)
-	// }
-	//
+// checkVersionName refuses versions that can't be used as the name of a
+// version directory
+func checkVersionName(version string) error {
+	if version == "" ||
+		filepath.Base(version) != version ||
+		strings.HasPrefix(version, ".") ||
+		version == tempDirectoryName {
+		return fmt.Errorf("Refusing version '%s', it is not a valid directory name", version)
+	}
+	return nil
+}
 
-	omahaRequest := omaha.Request{
-		Protocol: 3,
-		Application: omaha.App{
-			Channel:  updater.target.UpdateChannel,
-			ClientID: "1",
-			ID:       updater.target.AppID,
-			Version:  currentVersion,
-			Event: omaha.Event{
-				Type:   omaha.EventTypeUpdateCheck,
-				Result: omaha.EventResultTypeStarted,
-			},
-		},
+// checkPackageName refuses package names that can't be used as the name of
+// a file in the temp directory
+func checkPackageName(name string) error {
+	if name == "" ||
+		name == "." ||
+		name == ".." ||
+		filepath.Base(name) != name ||
+		strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("Refusing package '%s', it is not a valid file name", name)
 	}
+	return nil
+}
+
+// checkDowngrade refuses a manifest that is not newer than the installed
+// version, unless the update check is flagged as a rollback. It returns true
+// for a flagged rollback to an older or the same version
+func checkDowngrade(
+	scheme VersionScheme,
+	currentVersion string,
+	updateCheck omaha.UpdateCheck) (bool, error) {
 
+	current, err := scheme.Parse(currentVersion)
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse installed version: %s", err)
+	}
+	offered, err := scheme.Parse(updateCheck.Manifest.Version)
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse offered version: %s", err)
+	}
+	if offered.Compare(current) > 0 {
+		return false, nil
+	}
+	if updateCheck.Rollback == false {
+		return false, fmt.Errorf(
+			"Refusing version %s, it is not newer than the installed version %s",
+			updateCheck.Manifest.Version,
+			currentVersion)
+	}
+	return true, nil
+}
+
+// sendRequest posts the Omaha request to the update endpoint and returns the
+// response from the server
+func (updater *Unattended) sendRequest(
+	ctx context.Context,
+	omahaRequest omaha.Request) (omaha.Response, error) {
+
+	if omahaRequest.RequestID == "" {
+		requestID, err := newUUID()
+		if err != nil {
+			return omaha.Response{}, fmt.Errorf("invalid request: %s", err)
+		}
+		omahaRequest.RequestID = requestID
+	}
+	updater.identify(&omahaRequest)
 	omahaBytes, err := xml.Marshal(omahaRequest)
 	if err != nil {
-		return false, omaha.Manifest{}, fmt.Errorf(
-			"Unable to check for update, invalid request: %s",
-			err)
+		return omaha.Response{}, fmt.Errorf("invalid request: %s", err)
 	}
 
-	response, err := http.Post(
+	request, err := http.NewRequest(
+		http.MethodPost,
 		updater.target.UpdateEndpoint,
-		"application/xml",
 		bytes.NewReader(omahaBytes))
 	if err != nil {
-		return false, omaha.Manifest{}, fmt.Errorf(
-			"Unable to check for update, received API error: %s",
-			err)
+		return omaha.Response{}, fmt.Errorf("invalid request: %s", err)
 	}
+	request.Header.Set("Content-Type", "application/xml")
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return omaha.Response{}, fmt.Errorf("received API error: %s", err)
+	}
+	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return false, omaha.Manifest{},
-			fmt.Errorf(
-				"Unable to check for update, received HTTP status code %d: %s",
-				response.StatusCode,
-				response.Status)
+		return omaha.Response{}, fmt.Errorf(
+			"received HTTP status code %d: %s",
+			response.StatusCode,
+			response.Status)
 	}
 
-	var omahaResponse omaha.Response
-	err = xml.NewDecoder(response.Body).Decode(&omahaResponse)
+	// The signature covers the exact bytes of the body
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseSize))
 	if err != nil {
-		return false, omaha.Manifest{}, fmt.Errorf(
-			"Unable to check for update, received invalid response: %s",
-			err)
+		return omaha.Response{}, fmt.Errorf("received API error: %s", err)
 	}
 
-	// Error getting update information
-	if omahaResponse.Application.Status != "ok" {
-		return false, omaha.Manifest{}, fmt.Errorf(
-			"Received app status %s: %s",
-			omahaResponse.Application.Status,
-			omahaRequest.Application.Reason)
+	var omahaResponse omaha.Response
+	err = xml.Unmarshal(body, &omahaResponse)
+	if err != nil {
+		return omaha.Response{}, fmt.Errorf("received invalid response: %s", err)
 	}
-	// No update is available
-	if omahaResponse.Application.UpdateCheck.Status == "noupdate" {
-		return false, omaha.Manifest{}, nil
+	err = updater.verifyResponse(omahaRequest, omahaResponse, body, response.Header)
+	if err != nil {
+		return omaha.Response{}, fmt.Errorf("received unauthenticated response: %s", err)
 	}
-	if omahaResponse.Application.UpdateCheck.Status != "ok" {
-		return false, omaha.Manifest{}, fmt.Errorf(
-			"%s",
-			omahaResponse.Application.UpdateCheck.Status)
+	return omahaResponse, nil
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() (string, error) {
+	var uuid [16]byte
+	_, err := rand.Read(uuid[:])
+	if err != nil {
+		return "", err
 	}
-	return true, omahaResponse.Application.UpdateCheck.Manifest, nil
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf(
+		"%x-%x-%x-%x-%x",
+		uuid[0:4],
+		uuid[4:6],
+		uuid[6:8],
+		uuid[8:10],
+		uuid[10:16]), nil
 }
 
-// getAvailableUpdates checks for all packages that have updates available
-func (updater *Unattended) getAvailableUpdates() ([]omaha.Manifest, error) {
-	var omahaManifests []omaha.Manifest
+// getAvailableUpdates checks for updates of the target and its components in
+// a single request and returns the updates available. Failures of single
+// applications are logged and skipped
+func (updater *Unattended) getAvailableUpdates(ctx context.Context) ([]availableUpdate, error) {
+	installations := updater.installations()
+	currentVersions := make(map[string]string)
+	now := time.Now()
 
-	hasUpdate, omahaManifest, err := updater.isUpdateAvailable()
-	if err != nil {
-		return omahaManifests, err
+	omahaRequest := omaha.Request{
+		Protocol: 3,
 	}
-	if hasUpdate {
+	for _, installation := range installations {
+		currentVersion := updater.latestVersion(installation)
+		currentVersions[installation.appID] = currentVersion
 		updater.log.WithFields(logrus.Fields{
-			"app_id":            updater.target.AppID,
-			"available_version": omahaManifest.Version,
-		}).Debugf("Update available")
-		omahaManifests = append(omahaManifests, omahaManifest)
+			"app_id":          installation.appID,
+			"current_version": currentVersion,
+			"update_endpoint": updater.target.UpdateEndpoint,
+		}).Debug("Checking for update")
+
+		omahaRequest.Applications = append(omahaRequest.Applications, omaha.App{
+			Channel: installation.channel,
+			ID:      installation.appID,
+			Version: currentVersion,
+			Event: omaha.Event{
+				Type:   omaha.EventTypeUpdateCheck,
+				Result: omaha.EventResultTypeStarted,
+			},
+			UpdateCheck: &omaha.UpdateCheck{},
+			Ping:        updater.ping(installation.appID, now),
+		})
+	}
+
+	omahaResponse, err := updater.sendRequest(ctx, omahaRequest)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Unable to check for update, %s",
+			err)
+	}
+	updater.recordPings(omahaRequest, now)
+
+	omahaApps := make(map[string]omaha.App)
+	for _, omahaApp := range omahaResponse.Applications {
+		omahaApps[omahaApp.ID] = omahaApp
+	}
+
+	var updates []availableUpdate
+	for _, installation := range installations {
+		omahaApp, ok := omahaApps[installation.appID]
+		if ok == false {
+			updater.log.WithField(
+				"app_id", installation.appID,
+			).Warning("No update information received")
+			continue
+		}
+		hasUpdate, update, err := updater.isUpdateAvailable(
+			installation,
+			currentVersions[installation.appID],
+			omahaApp)
+		if err != nil {
+			updater.log.WithField(
+				"app_id", installation.appID,
+			).Warningf("Unable to check for update: %s", err)
+			continue
+		}
+		if hasUpdate {
+			updater.log.WithFields(logrus.Fields{
+				"app_id":            installation.appID,
+				"available_version": update.manifest.Version,
+				"rollback":          update.rollback,
+			}).Debugf("Update available")
+			updates = append(updates, update)
+		}
 	}
 
-	return omahaManifests, nil
+	return updates, nil
 }
 
 // GetLatestVersion returns the latest installed version
@@ -0,0 +1,46 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"testing"
+)
+
+func TestCheckPackageName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "app-1.0.0.tar.gz", valid: true},
+		{name: ".hidden.tar.gz", valid: true},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "../app.tar.gz"},
+		{name: "../../../etc/cron.d/x"},
+		{name: "sub/app.tar.gz"},
+		{name: "/etc/passwd"},
+		{name: "..\\app.tar.gz"},
+	}
+
+	for _, test := range tests {
+		err := checkPackageName(test.name)
+		if test.valid && err != nil {
+			t.Errorf("Expected '%s' to be valid, got %s", test.name, err)
+		}
+		if test.valid == false && err == nil {
+			t.Errorf("Expected '%s' to be refused", test.name)
+		}
+	}
+}
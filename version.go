@@ -0,0 +1,269 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VersionScheme parses and orders the versions of a target. The names of the
+// directories in Target.VersionsPath are parsed using the scheme
+type VersionScheme interface {
+	// Parse returns the version represented by the given string, or an error
+	// if the string is not a valid version in this scheme
+	Parse(version string) (Version, error)
+	// Initial returns the version reported when no version is installed
+	Initial() string
+}
+
+// Version is a single version parsed by a VersionScheme
+type Version interface {
+	// Compare returns -1, 0 or 1 when the version is lower than, equal to or
+	// higher than other. Other is always parsed by the same scheme
+	Compare(other Version) int
+	// String returns the version as it was parsed
+	String() string
+}
+
+// FourPartVersionScheme implements the 'major.minor.build.revision' scheme
+// used by the .NET version of Unattended. Versions with two or three parts
+// are accepted, missing parts are treated as 0. It is the default scheme
+type FourPartVersionScheme struct{}
+
+// fourPartVersion is a version parsed by FourPartVersionScheme
+type fourPartVersion struct {
+	original string
+	parts    [4]uint64
+}
+
+// Parse a four part version
+func (scheme FourPartVersionScheme) Parse(version string) (Version, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, fmt.Errorf(
+			"Version '%s' must have between 2 and 4 parts",
+			version)
+	}
+
+	parsed := fourPartVersion{original: version}
+	for i, part := range parts {
+		value, err := parseNumericIdentifier(part)
+		if err != nil {
+			return nil, fmt.Errorf("Version '%s' is invalid: %s", version, err)
+		}
+		parsed.parts[i] = value
+	}
+	return parsed, nil
+}
+
+// Initial returns the version reported when no version is installed
+func (scheme FourPartVersionScheme) Initial() string {
+	return "0.0.0.0"
+}
+
+// Compare the version to another four part version
+func (version fourPartVersion) Compare(other Version) int {
+	otherVersion := other.(fourPartVersion)
+	for i := range version.parts {
+		if version.parts[i] != otherVersion.parts[i] {
+			return compareUint(version.parts[i], otherVersion.parts[i])
+		}
+	}
+	return 0
+}
+
+// String returns the version as it was parsed
+func (version fourPartVersion) String() string {
+	return version.original
+}
+
+// SemanticVersionScheme implements Semantic Versioning 2.0.0, including
+// pre-release and build metadata, see https://semver.org
+type SemanticVersionScheme struct{}
+
+// semanticVersion is a version parsed by SemanticVersionScheme
+type semanticVersion struct {
+	original   string
+	major      uint64
+	minor      uint64
+	patch      uint64
+	preRelease []string
+	build      []string
+}
+
+// Parse a semantic version. A leading 'v' is allowed
+func (scheme SemanticVersionScheme) Parse(version string) (Version, error) {
+	parsed := semanticVersion{original: version}
+
+	remaining := strings.TrimPrefix(version, "v")
+	if index := strings.Index(remaining, "+"); index != -1 {
+		parsed.build = strings.Split(remaining[index+1:], ".")
+		remaining = remaining[:index]
+		for _, identifier := range parsed.build {
+			if isAlphanumericIdentifier(identifier) == false {
+				return nil, fmt.Errorf(
+					"Version '%s' has invalid build metadata '%s'",
+					version,
+					identifier)
+			}
+		}
+	}
+	if index := strings.Index(remaining, "-"); index != -1 {
+		parsed.preRelease = strings.Split(remaining[index+1:], ".")
+		remaining = remaining[:index]
+		for _, identifier := range parsed.preRelease {
+			if isAlphanumericIdentifier(identifier) == false {
+				return nil, fmt.Errorf(
+					"Version '%s' has invalid pre-release '%s'",
+					version,
+					identifier)
+			}
+			if isNumericIdentifier(identifier) && len(identifier) > 1 && identifier[0] == '0' {
+				return nil, fmt.Errorf(
+					"Version '%s' has a pre-release with a leading zero",
+					version)
+			}
+		}
+	}
+
+	parts := strings.Split(remaining, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf(
+			"Version '%s' must have the form major.minor.patch",
+			version)
+	}
+	numbers := []*uint64{&parsed.major, &parsed.minor, &parsed.patch}
+	for i, part := range parts {
+		if len(part) > 1 && part[0] == '0' {
+			return nil, fmt.Errorf(
+				"Version '%s' has a leading zero in '%s'",
+				version,
+				part)
+		}
+		value, err := parseNumericIdentifier(part)
+		if err != nil {
+			return nil, fmt.Errorf("Version '%s' is invalid: %s", version, err)
+		}
+		*numbers[i] = value
+	}
+	return parsed, nil
+}
+
+// Initial returns the version reported when no version is installed
+func (scheme SemanticVersionScheme) Initial() string {
+	return "0.0.0"
+}
+
+// Compare the version to another semantic version using the precedence
+// rules of the specification. Build metadata is ignored
+func (version semanticVersion) Compare(other Version) int {
+	otherVersion := other.(semanticVersion)
+	if version.major != otherVersion.major {
+		return compareUint(version.major, otherVersion.major)
+	}
+	if version.minor != otherVersion.minor {
+		return compareUint(version.minor, otherVersion.minor)
+	}
+	if version.patch != otherVersion.patch {
+		return compareUint(version.patch, otherVersion.patch)
+	}
+
+	// A version without a pre-release has higher precedence
+	if len(version.preRelease) == 0 || len(otherVersion.preRelease) == 0 {
+		return compareUint(
+			uint64(len(otherVersion.preRelease)),
+			uint64(len(version.preRelease)))
+	}
+	for i := 0; i < len(version.preRelease) && i < len(otherVersion.preRelease); i++ {
+		result := comparePreRelease(version.preRelease[i], otherVersion.preRelease[i])
+		if result != 0 {
+			return result
+		}
+	}
+	return compareUint(
+		uint64(len(version.preRelease)),
+		uint64(len(otherVersion.preRelease)))
+}
+
+// String returns the version as it was parsed
+func (version semanticVersion) String() string {
+	return version.original
+}
+
+// comparePreRelease compares a single pre-release identifier. Numeric
+// identifiers have lower precedence than alphanumeric identifiers
+func comparePreRelease(a string, b string) int {
+	aNumeric := isNumericIdentifier(a)
+	bNumeric := isNumericIdentifier(b)
+	switch {
+	case aNumeric && bNumeric:
+		aValue, _ := strconv.ParseUint(a, 10, 64)
+		bValue, _ := strconv.ParseUint(b, 10, 64)
+		return compareUint(aValue, bValue)
+	case aNumeric:
+		return -1
+	case bNumeric:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareUint returns -1, 0 or 1 when a is lower than, equal to or higher
+// than b
+func compareUint(a uint64, b uint64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// parseNumericIdentifier parses a non-empty string of digits
+func parseNumericIdentifier(identifier string) (uint64, error) {
+	if isNumericIdentifier(identifier) == false {
+		return 0, fmt.Errorf("'%s' is not numeric", identifier)
+	}
+	return strconv.ParseUint(identifier, 10, 64)
+}
+
+// isNumericIdentifier returns true if the identifier only contains digits
+func isNumericIdentifier(identifier string) bool {
+	if identifier == "" {
+		return false
+	}
+	for _, r := range identifier {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isAlphanumericIdentifier returns true if the identifier only contains
+// [0-9A-Za-z-]
+func isAlphanumericIdentifier(identifier string) bool {
+	if identifier == "" {
+		return false
+	}
+	for _, r := range identifier {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"testing"
+)
+
+func TestFourPartVersionSchemeOrdering(t *testing.T) {
+	tests := []struct {
+		a      string
+		b      string
+		result int
+	}{
+		{a: "1.0.0.0", b: "1.0.0.0", result: 0},
+		{a: "1.0", b: "1.0.0.0", result: 0},
+		{a: "1.2.3", b: "1.2.3.0", result: 0},
+		{a: "1.0.0.1", b: "1.0.0.0", result: 1},
+		{a: "1.0.0.0", b: "1.0.1.0", result: -1},
+		{a: "1.10.0.0", b: "1.9.0.0", result: 1},
+		{a: "2.0.0.0", b: "10.0.0.0", result: -1},
+		{a: "1.0.0.10", b: "1.0.0.9", result: 1},
+		{a: "01.0.0.0", b: "1.0.0.0", result: 0},
+	}
+
+	scheme := FourPartVersionScheme{}
+	for _, test := range tests {
+		t.Run(test.a+" "+test.b, func(t *testing.T) {
+			a, err := scheme.Parse(test.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := scheme.Parse(test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result := a.Compare(b); result != test.result {
+				t.Fatalf("Expected %d, got %d", test.result, result)
+			}
+			if result := b.Compare(a); result != -test.result {
+				t.Fatalf("Expected %d reversed, got %d", -test.result, result)
+			}
+		})
+	}
+}
+
+func TestFourPartVersionSchemeInvalid(t *testing.T) {
+	for _, version := range []string{"", "1", "1.0.0.0.0", "1..0", "1.a.0.0", "-1.0", "1.0.0.0 ", "v1.0.0.0"} {
+		_, err := FourPartVersionScheme{}.Parse(version)
+		if err == nil {
+			t.Errorf("Expected '%s' to be invalid", version)
+		}
+	}
+}
+
+func TestSemanticVersionSchemeOrdering(t *testing.T) {
+	// The precedence example of the specification, in increasing order
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.1.0",
+		"1.10.0",
+		"2.0.0",
+	}
+
+	scheme := SemanticVersionScheme{}
+	for i := range ordered {
+		for j := range ordered {
+			a, err := scheme.Parse(ordered[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := scheme.Parse(ordered[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := compareUint(uint64(i), uint64(j))
+			if result := a.Compare(b); result != expected {
+				t.Errorf("Comparing %s to %s: expected %d, got %d", ordered[i], ordered[j], expected, result)
+			}
+		}
+	}
+}
+
+func TestSemanticVersionSchemeEqual(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+	}{
+		{a: "1.0.0", b: "v1.0.0"},
+		{a: "1.0.0+build.1", b: "1.0.0+build.2"},
+		{a: "1.0.0-rc.1+linux", b: "1.0.0-rc.1"},
+	}
+
+	scheme := SemanticVersionScheme{}
+	for _, test := range tests {
+		t.Run(test.a+" "+test.b, func(t *testing.T) {
+			a, err := scheme.Parse(test.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := scheme.Parse(test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result := a.Compare(b); result != 0 {
+				t.Fatalf("Expected equal, got %d", result)
+			}
+		})
+	}
+}
+
+func TestSemanticVersionSchemeInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"1.0",
+		"1.0.0.0",
+		"01.0.0",
+		"1.00.0",
+		"1.0.0-",
+		"1.0.0-01",
+		"1.0.0-alpha..1",
+		"1.0.0+",
+		"1.0.0+build_1",
+		"1.0.0-alpha!",
+		"a.b.c",
+	}
+	for _, version := range invalid {
+		_, err := SemanticVersionScheme{}.Parse(version)
+		if err == nil {
+			t.Errorf("Expected '%s' to be invalid", version)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+/**
+* This file is part of Unattended.
+* Copyright © 2018 Donovan Solms.
+* Project Limitless
+* https://www.projectlimitless.io
+*
+* Unattended and Project Limitless is free software: you can redistribute it and/or modify
+* it under the terms of the Apache License Version 2.0.
+*
+* You should have received a copy of the Apache License Version 2.0 with
+* Unattended. If not, see http://www.apache.org/licenses/LICENSE-2.0.
+ */
+
+package unattended
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setXattr is not supported on this platform
+func setXattr(path string, name string, value []byte) error {
+	return fmt.Errorf("Extended attributes are not supported on %s", runtime.GOOS)
+}